@@ -0,0 +1,385 @@
+package dhttp
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/streamingfast/logging"
+	"go.uber.org/zap"
+)
+
+type BalancingStrategy int
+
+const (
+	// BalanceRoundRobin cycles through the healthy endpoints.
+	BalanceRoundRobin BalancingStrategy = iota
+
+	// BalanceLeastInFlight picks the healthy endpoint with the fewest in-flight requests.
+	BalanceLeastInFlight
+
+	// BalancePowerOfTwoChoices picks two random healthy endpoints and uses the one with
+	// the fewest in-flight requests.
+	BalancePowerOfTwoChoices
+)
+
+type BalancerOption func(t *BalancingRoundTripper)
+
+// BalancerStrategy sets the strategy used to pick the endpoint of each request, defaults
+// to `BalanceRoundRobin`.
+func BalancerStrategy(strategy BalancingStrategy) BalancerOption {
+	return func(t *BalancingRoundTripper) {
+		t.strategy = strategy
+	}
+}
+
+// BalancerEjection sets the number of consecutive failures after which an endpoint is
+// ejected as well as for how long it stays ejected before being re-admitted, defaults
+// to 5 failures and 30s.
+func BalancerEjection(consecutiveFailures int, duration time.Duration) BalancerOption {
+	return func(t *BalancingRoundTripper) {
+		t.ejectAfter = consecutiveFailures
+		t.ejectDuration = duration
+	}
+}
+
+// BalancerIsFailure sets the function deciding if the outcome of a request counts as a
+// failure of the endpoint, by default transport errors (excluding cancellation) and
+// `502`, `503` and `504` responses are failures.
+func BalancerIsFailure(isFailure func(response *http.Response, err error) bool) BalancerOption {
+	return func(t *BalancingRoundTripper) {
+		t.isFailure = isFailure
+	}
+}
+
+// BalancerHealthCheck enables background health checking, every `interval`, a `GET`
+// request is sent to `path` on each endpoint, a 2xx response re-admits the endpoint
+// while anything else ejects it. `Close` must be called to stop health checking.
+func BalancerHealthCheck(path string, interval time.Duration) BalancerOption {
+	return func(t *BalancingRoundTripper) {
+		t.healthCheckPath = path
+		t.healthCheckInterval = interval
+	}
+}
+
+// BalancerLogger sets the logger used to log ejections and re-admissions.
+func BalancerLogger(logger *zap.Logger) BalancerOption {
+	return func(t *BalancingRoundTripper) {
+		t.logger = logger
+	}
+}
+
+// NewBalancingRoundTripper creates a wrapping `http.RoundTripper` spreading requests over
+// a set of replicas. Each request's scheme and host are rewritten to the ones of the
+// picked endpoint (a base URL like `http://replica-1:8080`, its path, if any, prefixes
+// the request's path), the endpoint being picked according to the `BalancerStrategy`.
+//
+// Endpoints failing consecutively (see `BalancerEjection` and `BalancerIsFailure`) are
+// ejected for a while, then re-admitted. When all endpoints are ejected, all of them are
+// considered again. When the request is idempotent and its body can be rewound (see
+// `NewRetryingRoundTripper`), a transport error fails over to the next endpoint.
+//
+// If the received `next` argument is set as `nil`, the `http.DefaultTransport` value
+// will be used as the actual transport handler.
+func NewBalancingRoundTripper(endpoints []string, next http.RoundTripper, opts ...BalancerOption) (*BalancingRoundTripper, error) {
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("at least one endpoint is required")
+	}
+
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	t := &BalancingRoundTripper{
+		transport:     next,
+		logger:        zlog,
+		ejectAfter:    5,
+		ejectDuration: 30 * time.Second,
+		isFailure:     isUnavailable,
+		now:           time.Now,
+		done:          make(chan struct{}),
+	}
+
+	for _, endpoint := range endpoints {
+		parsed, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+		}
+
+		if parsed.Scheme == "" || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid endpoint %q: scheme and host are required", endpoint)
+		}
+
+		t.endpoints = append(t.endpoints, &balancedEndpoint{url: parsed})
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	if t.healthCheckInterval > 0 {
+		go t.healthCheck()
+	}
+
+	return t, nil
+}
+
+type BalancingRoundTripper struct {
+	transport           http.RoundTripper
+	logger              *zap.Logger
+	endpoints           []*balancedEndpoint
+	strategy            BalancingStrategy
+	ejectAfter          int
+	ejectDuration       time.Duration
+	isFailure           func(response *http.Response, err error) bool
+	healthCheckPath     string
+	healthCheckInterval time.Duration
+	now                 func() time.Time
+
+	next      uint64
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type balancedEndpoint struct {
+	url      *url.URL
+	inFlight int64
+
+	lock                sync.Mutex
+	consecutiveFailures int
+	ejectedUntil        time.Time
+}
+
+func (e *balancedEndpoint) healthy(now time.Time) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return !now.Before(e.ejectedUntil)
+}
+
+// Close stops background health checking, if enabled.
+func (t *BalancingRoundTripper) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
+	return nil
+}
+
+func (t *BalancingRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	canFailover := isIdempotent(request) && (request.Body == nil || request.Body == http.NoBody || request.GetBody != nil)
+
+	tried := map[*balancedEndpoint]bool{}
+	for attempt := 1; ; attempt++ {
+		endpoint := t.pick(tried)
+		tried[endpoint] = true
+
+		attemptRequest, err := rewindRequest(request, attempt)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := t.roundTripEndpoint(attemptRequest, endpoint)
+		if err == nil || !canFailover || len(tried) == len(t.endpoints) || request.Context().Err() != nil {
+			return response, err
+		}
+
+		logging.Logger(request.Context(), t.logger).Debug(fmt.Sprintf("failing over HTTP request %s %s", request.Method, request.URL.String()),
+			zap.String("endpoint", endpoint.url.Host),
+			zap.Error(err),
+		)
+	}
+}
+
+func (t *BalancingRoundTripper) roundTripEndpoint(request *http.Request, endpoint *balancedEndpoint) (*http.Response, error) {
+	rewritten := request.Clone(request.Context())
+	rewritten.Body = request.Body
+	rewritten.URL.Scheme = endpoint.url.Scheme
+	rewritten.URL.Host = endpoint.url.Host
+	rewritten.Host = ""
+	if prefix := strings.TrimSuffix(endpoint.url.Path, "/"); prefix != "" {
+		rewritten.URL.Path = prefix + request.URL.Path
+		if request.URL.RawPath != "" {
+			rewritten.URL.RawPath = prefix + request.URL.RawPath
+		}
+	}
+
+	atomic.AddInt64(&endpoint.inFlight, 1)
+	response, err := t.transport.RoundTrip(rewritten)
+	if err != nil {
+		atomic.AddInt64(&endpoint.inFlight, -1)
+	} else {
+		response.Body = newReleasingBody(response.Body, onceFunc(func() { atomic.AddInt64(&endpoint.inFlight, -1) }))
+	}
+
+	t.report(request.Context(), endpoint, !t.isFailure(response, err))
+
+	return response, err
+}
+
+// pick selects the endpoint of the next attempt among the healthy ones not tried yet.
+func (t *BalancingRoundTripper) pick(tried map[*balancedEndpoint]bool) *balancedEndpoint {
+	now := t.now()
+
+	var candidates []*balancedEndpoint
+	for _, endpoint := range t.endpoints {
+		if !tried[endpoint] && endpoint.healthy(now) {
+			candidates = append(candidates, endpoint)
+		}
+	}
+
+	if len(candidates) == 0 {
+		// All remaining endpoints are ejected, better to try one of them than failing right away
+		for _, endpoint := range t.endpoints {
+			if !tried[endpoint] {
+				candidates = append(candidates, endpoint)
+			}
+		}
+	}
+
+	switch t.strategy {
+	case BalanceLeastInFlight:
+		best := candidates[0]
+		for _, candidate := range candidates[1:] {
+			if atomic.LoadInt64(&candidate.inFlight) < atomic.LoadInt64(&best.inFlight) {
+				best = candidate
+			}
+		}
+
+		return best
+
+	case BalancePowerOfTwoChoices:
+		if len(candidates) == 1 {
+			return candidates[0]
+		}
+
+		first := rand.Intn(len(candidates))
+		second := rand.Intn(len(candidates) - 1)
+		if second >= first {
+			second++
+		}
+
+		if atomic.LoadInt64(&candidates[second].inFlight) < atomic.LoadInt64(&candidates[first].inFlight) {
+			return candidates[second]
+		}
+
+		return candidates[first]
+
+	default:
+		return candidates[int(atomic.AddUint64(&t.next, 1)-1)%len(candidates)]
+	}
+}
+
+func (t *BalancingRoundTripper) report(ctx context.Context, endpoint *balancedEndpoint, success bool) {
+	endpoint.lock.Lock()
+	defer endpoint.lock.Unlock()
+
+	if success {
+		if !endpoint.ejectedUntil.IsZero() {
+			logging.Logger(ctx, t.logger).Info("re-admitting endpoint", zap.String("endpoint", endpoint.url.String()))
+		}
+
+		endpoint.consecutiveFailures = 0
+		endpoint.ejectedUntil = time.Time{}
+		return
+	}
+
+	endpoint.consecutiveFailures++
+	if endpoint.consecutiveFailures >= t.ejectAfter {
+		t.eject(ctx, endpoint)
+	}
+}
+
+// eject ejects the endpoint unless it's already ejected, the endpoint's lock must be
+// held by the caller. The failures are reset so that, once re-admitted, the endpoint
+// is ejected again only after as many consecutive failures.
+func (t *BalancingRoundTripper) eject(ctx context.Context, endpoint *balancedEndpoint) {
+	now := t.now()
+	if now.Before(endpoint.ejectedUntil) {
+		return
+	}
+
+	endpoint.ejectedUntil = now.Add(t.ejectDuration)
+	logging.Logger(ctx, t.logger).Info("ejecting endpoint",
+		zap.String("endpoint", endpoint.url.String()),
+		zap.Int("consecutive_failures", endpoint.consecutiveFailures),
+		zap.Duration("duration", t.ejectDuration),
+	)
+
+	endpoint.consecutiveFailures = 0
+}
+
+func (t *BalancingRoundTripper) healthCheck() {
+	ticker := time.NewTicker(t.healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			// Checked concurrently so that a hanging endpoint does not delay the others
+			var wg sync.WaitGroup
+			for _, endpoint := range t.endpoints {
+				wg.Add(1)
+				go func(endpoint *balancedEndpoint) {
+					defer wg.Done()
+					t.checkEndpoint(endpoint)
+				}(endpoint)
+			}
+			wg.Wait()
+		}
+	}
+}
+
+func (t *BalancingRoundTripper) checkEndpoint(endpoint *balancedEndpoint) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.healthCheckInterval)
+	defer cancel()
+
+	checkURL := *endpoint.url
+	checkURL.Path = strings.TrimSuffix(checkURL.Path, "/") + "/" + strings.TrimPrefix(t.healthCheckPath, "/")
+
+	healthy := false
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, checkURL.String(), nil)
+	if err == nil {
+		response, err := t.transport.RoundTrip(request)
+		if err == nil {
+			drainAndClose(response.Body)
+			healthy = response.StatusCode >= 200 && response.StatusCode <= 299
+		}
+	}
+
+	if healthy {
+		t.report(ctx, endpoint, true)
+		return
+	}
+
+	endpoint.lock.Lock()
+	defer endpoint.lock.Unlock()
+
+	endpoint.consecutiveFailures++
+	t.eject(ctx, endpoint)
+}
+
+// isUnavailable returns true on transport errors (excluding cancellation) and on
+// responses indicating the upstream is unavailable.
+func isUnavailable(response *http.Response, err error) bool {
+	if err != nil {
+		return classifyTransportError(err) != transportErrorCancelled
+	}
+
+	switch response.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+func onceFunc(fn func()) func() {
+	var once sync.Once
+	return func() { once.Do(fn) }
+}
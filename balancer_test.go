@@ -0,0 +1,117 @@
+package dhttp
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBalancingRoundTripper(t *testing.T) {
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.URL.Path))
+		}))
+	}
+
+	a, b := newServer("a"), newServer("b")
+	defer a.Close()
+	defer b.Close()
+
+	get := func(t *testing.T, client *http.Client) string {
+		response, err := client.Get("http://service/resource")
+		require.NoError(t, err)
+		defer response.Body.Close()
+
+		body, _ := io.ReadAll(response.Body)
+		return string(body)
+	}
+
+	t.Run("round robin", func(t *testing.T) {
+		balancer, err := NewBalancingRoundTripper([]string{a.URL, b.URL + "/prefix"}, nil)
+		require.NoError(t, err)
+
+		client := &http.Client{Transport: balancer}
+		assert.Equal(t, "a /resource", get(t, client))
+		assert.Equal(t, "b /prefix/resource", get(t, client))
+		assert.Equal(t, "a /resource", get(t, client))
+	})
+
+	t.Run("failover and ejection", func(t *testing.T) {
+		down := newServer("down")
+		down.Close()
+
+		balancer, err := NewBalancingRoundTripper([]string{down.URL, b.URL}, nil, BalancerEjection(1, time.Minute))
+		require.NoError(t, err)
+
+		client := &http.Client{Transport: balancer}
+		for i := 0; i < 4; i++ {
+			assert.Equal(t, "b /resource", get(t, client))
+		}
+
+		assert.False(t, balancer.endpoints[0].healthy(time.Now()))
+		assert.True(t, balancer.endpoints[1].healthy(time.Now()))
+	})
+
+	t.Run("least in flight", func(t *testing.T) {
+		balancer, err := NewBalancingRoundTripper([]string{a.URL, b.URL}, nil, BalancerStrategy(BalanceLeastInFlight))
+		require.NoError(t, err)
+
+		client := &http.Client{Transport: balancer}
+		response, err := client.Get("http://service/held")
+		require.NoError(t, err)
+
+		// The first endpoint has a request in flight until its body is closed
+		assert.Equal(t, "b /resource", get(t, client))
+		response.Body.Close()
+		assert.Equal(t, "a /resource", get(t, client))
+	})
+}
+
+func TestBalancingRoundTripper_Readmission(t *testing.T) {
+	now := time.Now()
+	balancer, err := NewBalancingRoundTripper([]string{"http://a"}, nil, BalancerEjection(2, time.Minute))
+	require.NoError(t, err)
+	balancer.now = func() time.Time { return now }
+
+	endpoint := balancer.endpoints[0]
+	balancer.report(context.Background(), endpoint, false)
+	balancer.report(context.Background(), endpoint, false)
+	assert.False(t, endpoint.healthy(now))
+
+	// Once re-admitted, a single failure is not enough to eject the endpoint again
+	now = now.Add(2 * time.Minute)
+	assert.True(t, endpoint.healthy(now))
+
+	balancer.report(context.Background(), endpoint, false)
+	assert.True(t, endpoint.healthy(now))
+
+	balancer.report(context.Background(), endpoint, false)
+	assert.False(t, endpoint.healthy(now))
+}
+
+func TestBalancingRoundTripper_SwitchingProtocols(t *testing.T) {
+	transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusSwitchingProtocols, Header: http.Header{}, Body: &readWriteCloser{}}, nil
+	})
+
+	balancer, err := NewBalancingRoundTripper([]string{"http://a"}, transport)
+	require.NoError(t, err)
+
+	request, err := http.NewRequest("GET", "http://service/ws", nil)
+	require.NoError(t, err)
+
+	response, err := balancer.RoundTrip(request)
+	require.NoError(t, err)
+
+	_, writable := response.Body.(io.ReadWriteCloser)
+	assert.True(t, writable, "upgraded body must remain writable")
+
+	response.Body.Close()
+	assert.Equal(t, int64(0), balancer.endpoints[0].inFlight)
+}
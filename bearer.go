@@ -0,0 +1,338 @@
+package dhttp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streamingfast/logging"
+	"go.uber.org/zap"
+)
+
+// tokenRefreshTimeout bounds the time spent obtaining a new token from a `TokenSource`.
+const tokenRefreshTimeout = 30 * time.Second
+
+// Token is an access token sent as a `Bearer` token by a `BearerTokenRoundTripper`.
+type Token struct {
+	AccessToken string
+
+	// ExpiresAt is the time after which the token is not valid anymore, a zero value
+	// means the token never expires.
+	ExpiresAt time.Time
+}
+
+// TokenSource provides access tokens, it's invoked each time a new token is required, the
+// `BearerTokenRoundTripper` takes care of caching and refreshing it.
+type TokenSource interface {
+	Token(ctx context.Context) (*Token, error)
+}
+
+// TokenSourceFunc is an adapter to use a plain function as a `TokenSource`.
+type TokenSourceFunc func(ctx context.Context) (*Token, error)
+
+func (f TokenSourceFunc) Token(ctx context.Context) (*Token, error) { return f(ctx) }
+
+// StaticTokenSource returns a `TokenSource` always returning the same never expiring token.
+func StaticTokenSource(accessToken string) TokenSource {
+	return TokenSourceFunc(func(ctx context.Context) (*Token, error) {
+		return &Token{AccessToken: accessToken}, nil
+	})
+}
+
+type ClientCredentialsOption func(s *ClientCredentialsTokenSource)
+
+// ClientCredentialsScopes sets the scopes requested to the token endpoint.
+func ClientCredentialsScopes(scopes ...string) ClientCredentialsOption {
+	return func(s *ClientCredentialsTokenSource) {
+		s.scopes = scopes
+	}
+}
+
+// ClientCredentialsParam adds an extra form parameter (e.g. `audience`) sent to the token endpoint.
+func ClientCredentialsParam(key string, value string) ClientCredentialsOption {
+	return func(s *ClientCredentialsTokenSource) {
+		s.params.Add(key, value)
+	}
+}
+
+// ClientCredentialsHTTPClient sets the `http.Client` used to reach the token endpoint,
+// defaults to `http.DefaultClient`.
+func ClientCredentialsHTTPClient(httpClient *http.Client) ClientCredentialsOption {
+	return func(s *ClientCredentialsTokenSource) {
+		s.httpClient = httpClient
+	}
+}
+
+// NewClientCredentialsTokenSource creates a `TokenSource` obtaining tokens through the
+// OAuth2 client credentials flow (RFC 6749, section 4.4) against `tokenURL`, the client
+// authenticating with HTTP Basic authentication.
+func NewClientCredentialsTokenSource(tokenURL string, clientID string, clientSecret string, opts ...ClientCredentialsOption) *ClientCredentialsTokenSource {
+	s := &ClientCredentialsTokenSource{
+		tokenURL:     tokenURL,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		params:       url.Values{},
+		httpClient:   http.DefaultClient,
+		now:          time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+type ClientCredentialsTokenSource struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       []string
+	params       url.Values
+	httpClient   *http.Client
+	now          func() time.Time
+}
+
+func (s *ClientCredentialsTokenSource) Token(ctx context.Context) (*Token, error) {
+	form := url.Values{}
+	for key, values := range s.params {
+		form[key] = values
+	}
+
+	form.Set("grant_type", "client_credentials")
+	if len(s.scopes) > 0 {
+		form.Set("scope", strings.Join(s.scopes, " "))
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create token request: %w", err)
+	}
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.SetBasicAuth(url.QueryEscape(s.clientID), url.QueryEscape(s.clientSecret))
+
+	requestTime := s.now()
+	response, err := s.httpClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach token endpoint: %w", err)
+	}
+	defer response.Body.Close()
+
+	content, err := io.ReadAll(io.LimitReader(response.Body, maxErrorBodyBytes))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token response: %w", err)
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, fmt.Errorf("token endpoint responded with status %d: %s", response.StatusCode, content)
+	}
+
+	tokenResponse := struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{}
+
+	if err := json.Unmarshal(content, &tokenResponse); err != nil {
+		return nil, fmt.Errorf("unable to decode token response: %w", err)
+	}
+
+	if tokenResponse.AccessToken == "" {
+		return nil, fmt.Errorf("token endpoint response has no access token")
+	}
+
+	if tokenResponse.TokenType != "" && !strings.EqualFold(tokenResponse.TokenType, "bearer") {
+		return nil, fmt.Errorf("token endpoint returned unsupported token type %q", tokenResponse.TokenType)
+	}
+
+	token := &Token{AccessToken: tokenResponse.AccessToken}
+	if tokenResponse.ExpiresIn > 0 {
+		// Relative to the request time so that the token expires before upstream considers it expired
+		token.ExpiresAt = requestTime.Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+	}
+
+	return token, nil
+}
+
+type BearerTokenOption func(t *BearerTokenRoundTripper)
+
+// BearerTokenRefreshBefore sets how long before its expiration a token is refreshed,
+// defaults to 1 minute. Requests keep using the current token while it's being refreshed
+// in the background.
+func BearerTokenRefreshBefore(duration time.Duration) BearerTokenOption {
+	return func(t *BearerTokenRoundTripper) {
+		t.refreshBefore = duration
+	}
+}
+
+// BearerTokenLogger sets the logger used to log token refreshes, the request specific
+// logger is used if one exists in the request's context.
+func BearerTokenLogger(logger *zap.Logger) BearerTokenOption {
+	return func(t *BearerTokenRoundTripper) {
+		t.logger = logger
+	}
+}
+
+// NewBearerTokenRoundTripper creates a wrapping `http.RoundTripper` authenticating each
+// request with an `Authorization: Bearer <token>` header, the token being obtained from
+// `source` (see `NewClientCredentialsTokenSource` and `StaticTokenSource`).
+//
+// The token is cached and refreshed proactively before it expires, with a single refresh
+// in flight at any time. When upstream responds with `401 Unauthorized`, the token is
+// refreshed and the request retried once, if its body can be rewound.
+//
+// If the received `next` argument is set as `nil`, the `http.DefaultTransport` value
+// will be used as the actual transport handler.
+func NewBearerTokenRoundTripper(source TokenSource, next http.RoundTripper, opts ...BearerTokenOption) *BearerTokenRoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	t := &BearerTokenRoundTripper{
+		source:        source,
+		transport:     next,
+		logger:        zlog,
+		refreshBefore: time.Minute,
+		now:           time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	return t
+}
+
+type BearerTokenRoundTripper struct {
+	source        TokenSource
+	transport     http.RoundTripper
+	logger        *zap.Logger
+	refreshBefore time.Duration
+	now           func() time.Time
+
+	lock       sync.Mutex
+	token      *Token
+	refreshing *tokenRefresh
+}
+
+type tokenRefresh struct {
+	done  chan struct{}
+	token *Token
+	err   error
+}
+
+func (t *BearerTokenRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	token, err := t.currentToken(request.Context(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := t.roundTripWithToken(request, request.Body, token)
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		return response, err
+	}
+
+	if request.Body != nil && request.Body != http.NoBody && request.GetBody == nil {
+		return response, nil
+	}
+
+	freshToken, err := t.currentToken(request.Context(), token)
+	if err != nil {
+		// We keep the original 401 response, it's more meaningful to the caller than the refresh failure
+		logging.Logger(request.Context(), t.logger).Debug("unable to refresh token after unauthorized response", zap.Error(err))
+		return response, nil
+	}
+
+	retryRequest, err := rewindRequest(request, 2)
+	if err != nil {
+		return response, nil
+	}
+	drainAndClose(response.Body)
+
+	return t.roundTripWithToken(request, retryRequest.Body, freshToken)
+}
+
+func (t *BearerTokenRoundTripper) roundTripWithToken(request *http.Request, body io.ReadCloser, token *Token) (*http.Response, error) {
+	authenticated := request.Clone(request.Context())
+	authenticated.Body = body
+	authenticated.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	return t.transport.RoundTrip(authenticated)
+}
+
+// currentToken returns a valid token, refreshing it if required. When `rejected` is set,
+// it's a token upstream refused, a new one is obtained unless it was already replaced.
+func (t *BearerTokenRoundTripper) currentToken(ctx context.Context, rejected *Token) (*Token, error) {
+	t.lock.Lock()
+
+	now := t.now()
+	token := t.token
+	if token != nil && token == rejected {
+		t.token = nil
+		token = nil
+	}
+
+	if token != nil && (token.ExpiresAt.IsZero() || now.Before(token.ExpiresAt.Add(-t.refreshBefore))) {
+		t.lock.Unlock()
+		return token, nil
+	}
+
+	refresh := t.startRefresh(ctx)
+	t.lock.Unlock()
+
+	if token != nil && now.Before(token.ExpiresAt) {
+		// About to expire but still valid, keep using it while the refresh happens in the background
+		return token, nil
+	}
+
+	select {
+	case <-refresh.done:
+		return refresh.token, refresh.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// startRefresh starts a token refresh if none is in flight, the lock must be held by the caller.
+func (t *BearerTokenRoundTripper) startRefresh(ctx context.Context) *tokenRefresh {
+	if t.refreshing != nil {
+		return t.refreshing
+	}
+
+	refresh := &tokenRefresh{done: make(chan struct{})}
+	t.refreshing = refresh
+
+	go func() {
+		defer close(refresh.done)
+
+		// The refresh is shared by all requests, it must not be cancelled by the one that triggered it
+		refreshCtx, cancel := context.WithTimeout(detachedContext{ctx}, tokenRefreshTimeout)
+		defer cancel()
+
+		refresh.token, refresh.err = t.source.Token(refreshCtx)
+		if refresh.err != nil {
+			refresh.err = fmt.Errorf("unable to obtain token: %w", refresh.err)
+		} else if refresh.token == nil || refresh.token.AccessToken == "" {
+			refresh.token, refresh.err = nil, fmt.Errorf("unable to obtain token: token source returned no access token")
+		}
+
+		t.lock.Lock()
+		defer t.lock.Unlock()
+
+		t.refreshing = nil
+		if refresh.err == nil {
+			t.token = refresh.token
+			logging.Logger(ctx, t.logger).Debug("refreshed bearer token", zap.Time("expires_at", refresh.token.ExpiresAt))
+		}
+	}()
+
+	return refresh
+}
@@ -0,0 +1,82 @@
+package dhttp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBearerTokenRoundTripper_ClientCredentials(t *testing.T) {
+	var tokenCalls int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, _ := r.BasicAuth()
+		assert.Equal(t, "client", clientID)
+		assert.Equal(t, "secret", clientSecret)
+		assert.Equal(t, "client_credentials", r.FormValue("grant_type"))
+		assert.Equal(t, "read write", r.FormValue("scope"))
+
+		calls := atomic.AddInt32(&tokenCalls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"Bearer","expires_in":3600}`, calls)
+	}))
+	defer tokenServer.Close()
+
+	// The first token is considered revoked by upstream
+	var apiCalls int32
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&apiCalls, 1)
+		if r.Header.Get("Authorization") == "Bearer token-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer apiServer.Close()
+
+	source := NewClientCredentialsTokenSource(tokenServer.URL, "client", "secret", ClientCredentialsScopes("read", "write"))
+	client := &http.Client{Transport: NewBearerTokenRoundTripper(source, nil)}
+
+	for i := 0; i < 3; i++ {
+		request, _ := http.NewRequest("POST", apiServer.URL, strings.NewReader("body"))
+		response, err := client.Do(request)
+		require.NoError(t, err)
+		response.Body.Close()
+
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+	}
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&tokenCalls), "token should be refreshed once after the 401")
+	assert.Equal(t, int32(4), atomic.LoadInt32(&apiCalls))
+}
+
+func TestBearerTokenRoundTripper_EmptyToken(t *testing.T) {
+	tests := []struct {
+		name  string
+		token *Token
+	}{
+		{"nil token", nil},
+		{"empty access token", &Token{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := TokenSourceFunc(func(ctx context.Context) (*Token, error) { return test.token, nil })
+			transport := NewBearerTokenRoundTripper(source, roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				t.Fatal("request must not be sent without a token")
+				return nil, nil
+			}))
+
+			request, _ := http.NewRequest("GET", "http://upstream/", nil)
+			_, err := transport.RoundTrip(request)
+			assert.ErrorContains(t, err, "no access token")
+		})
+	}
+}
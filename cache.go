@@ -0,0 +1,533 @@
+package dhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/streamingfast/logging"
+	"go.uber.org/zap"
+)
+
+// CacheStatusHeader is the response header set by a `CachingRoundTripper` to indicate
+// how the response was served, one of `CacheHit`, `CacheMiss` or `CacheRevalidated`.
+const CacheStatusHeader = "X-Cache"
+
+const (
+	CacheHit         = "HIT"
+	CacheMiss        = "MISS"
+	CacheRevalidated = "REVALIDATED"
+)
+
+// maxHeuristicFreshness caps the freshness lifetime computed from `Last-Modified`
+// when the response has no explicit expiration.
+const maxHeuristicFreshness = 24 * time.Hour
+
+// heuristicallyCacheableStatuses are the statuses defined as heuristically cacheable by
+// RFC 9110 (section 15.1), `206 Partial Content` excluded as ranges are not supported.
+var heuristicallyCacheableStatuses = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+type CacheOption func(t *CachingRoundTripper)
+
+// CacheMaxEntrySize sets the maximum body size of a cacheable response, bigger responses
+// are passed through without being stored. Defaults to 10 MiB.
+func CacheMaxEntrySize(maxSize int64) CacheOption {
+	return func(t *CachingRoundTripper) {
+		t.maxEntrySize = maxSize
+	}
+}
+
+// CacheLogger sets the logger used to log cache decisions, the request specific logger
+// is used if one exists in the request's context.
+func CacheLogger(logger *zap.Logger) CacheOption {
+	return func(t *CachingRoundTripper) {
+		t.logger = logger
+	}
+}
+
+// NewCachingRoundTripper creates a wrapping `http.RoundTripper` acting as a private HTTP
+// cache (RFC 9111) backed by `storage` (see `NewMemoryCacheStorage` and `NewDiskCacheStorage`).
+//
+// Only `GET` responses are stored, according to their `Cache-Control` (`max-age`,
+// `no-store`, `no-cache`) and `Expires` headers, falling back to a heuristic based on
+// `Last-Modified`. Stale responses having an `ETag` or `Last-Modified` validator are
+// revalidated with a conditional request, fresh `immutable` ones are never revalidated.
+// Responses varying on request headers (`Vary`) are served only to requests with the
+// same values for those headers, a single variant is kept per URL. Responses to requests
+// having an `Authorization` header are stored only if marked `public`, `must-revalidate`
+// or `s-maxage` as they are shared by all callers.
+//
+// The request's `Cache-Control` directives `no-store`, `no-cache`, `max-age`, `min-fresh`
+// and `only-if-cached` are honoured. Successful unsafe requests (`POST`, `PUT`, `DELETE`,
+// etc.) invalidate the stored response of their URL.
+//
+// Every response gets a `CacheStatusHeader` header which is logged by a wrapping
+// `LoggingRoundTripper`:
+//
+//	NewLoggingRoundTripper(zlog, tracer, NewCachingRoundTripper(NewMemoryCacheStorage(64*1024*1024), nil))
+//
+// If the received `next` argument is set as `nil`, the `http.DefaultTransport` value
+// will be used as the actual transport handler.
+func NewCachingRoundTripper(storage CacheStorage, next http.RoundTripper, opts ...CacheOption) *CachingRoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	t := &CachingRoundTripper{
+		storage:      storage,
+		transport:    next,
+		logger:       zlog,
+		maxEntrySize: 10 * 1024 * 1024,
+		now:          time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	return t
+}
+
+type CachingRoundTripper struct {
+	storage      CacheStorage
+	transport    http.RoundTripper
+	logger       *zap.Logger
+	maxEntrySize int64
+	now          func() time.Time
+}
+
+func (t *CachingRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Method != http.MethodGet {
+		return t.roundTripUncached(request)
+	}
+
+	requestDirectives := parseCacheControl(request.Header)
+	if requestDirectives.has("no-store") || hasConditionalHeaders(request.Header) {
+		return t.forward(request)
+	}
+
+	logger := logging.Logger(request.Context(), t.logger)
+	key := cacheKey(request)
+
+	entry := t.load(key, logger)
+	if entry != nil && !entry.varyMatches(request) {
+		entry = nil
+	}
+
+	if entry != nil && t.isUsable(entry, requestDirectives) {
+		return entry.toResponse(request, CacheHit, t.now()), nil
+	}
+
+	if requestDirectives.has("only-if-cached") {
+		return gatewayTimeoutResponse(request), nil
+	}
+
+	upstreamRequest := request
+	if entry != nil && entry.hasValidators() {
+		upstreamRequest = request.Clone(request.Context())
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			upstreamRequest.Header.Set("If-None-Match", etag)
+		}
+
+		if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+			upstreamRequest.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	requestTime := t.now()
+	response, err := t.transport.RoundTrip(upstreamRequest)
+	if err != nil {
+		return nil, err
+	}
+	responseTime := t.now()
+
+	if entry != nil && response.StatusCode == http.StatusNotModified {
+		drainAndClose(response.Body)
+
+		entry.update(response.Header, requestTime, responseTime)
+		t.store(key, entry, logger)
+
+		return entry.toResponse(request, CacheRevalidated, t.now()), nil
+	}
+
+	if !t.isStorable(request, response) {
+		response.Header.Set(CacheStatusHeader, CacheMiss)
+		return response, nil
+	}
+
+	body, complete, err := readLimitedBody(response, t.maxEntrySize)
+	if err != nil {
+		return nil, err
+	}
+
+	if complete {
+		t.store(key, newCacheEntry(request, response, body, requestTime, responseTime), logger)
+	}
+
+	response.Header.Set(CacheStatusHeader, CacheMiss)
+	return response, nil
+}
+
+// roundTripUncached forwards non-GET requests, invalidating the stored response of the
+// URL when an unsafe request succeeded.
+func (t *CachingRoundTripper) roundTripUncached(request *http.Request) (*http.Response, error) {
+	response, err := t.forward(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isSafeMethod(request.Method) && response.StatusCode < 400 {
+		t.storage.Delete(cacheKey(request))
+	}
+
+	return response, nil
+}
+
+func (t *CachingRoundTripper) forward(request *http.Request) (*http.Response, error) {
+	response, err := t.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	response.Header.Set(CacheStatusHeader, CacheMiss)
+	return response, nil
+}
+
+func (t *CachingRoundTripper) load(key string, logger *zap.Logger) *cacheEntry {
+	content, found := t.storage.Get(key)
+	if !found {
+		return nil
+	}
+
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(content, entry); err != nil {
+		logger.Debug("discarding invalid cache entry", zap.String("key", key), zap.Error(err))
+		t.storage.Delete(key)
+		return nil
+	}
+
+	return entry
+}
+
+func (t *CachingRoundTripper) store(key string, entry *cacheEntry, logger *zap.Logger) {
+	content, err := json.Marshal(entry)
+	if err != nil {
+		logger.Debug("unable to encode cache entry", zap.String("key", key), zap.Error(err))
+		return
+	}
+
+	t.storage.Set(key, content)
+}
+
+// isUsable returns whether the entry can be served without contacting upstream.
+func (t *CachingRoundTripper) isUsable(entry *cacheEntry, requestDirectives cacheControl) bool {
+	age := entry.age(t.now())
+	lifetime := entry.freshnessLifetime()
+
+	// An immutable response is not revalidated while fresh, even if the request asks for it (RFC 8246)
+	if requestDirectives.has("no-cache") && !(parseCacheControl(entry.Header).has("immutable") && age < lifetime) {
+		return false
+	}
+
+	if maxAge, ok := requestDirectives.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+
+	if minFresh, ok := requestDirectives.seconds("min-fresh"); ok {
+		age += minFresh
+	}
+
+	return age < lifetime
+}
+
+func (t *CachingRoundTripper) isStorable(request *http.Request, response *http.Response) bool {
+	directives := parseCacheControl(response.Header)
+	if directives.has("no-store") || strings.TrimSpace(response.Header.Get("Vary")) == "*" {
+		return false
+	}
+
+	// The key does not include the credentials, a response to an authenticated request is
+	// stored only if upstream explicitly allows sharing it (RFC 9111, section 3.5)
+	if request.Header.Get("Authorization") != "" && !directives.has("public") && !directives.has("must-revalidate") {
+		if _, hasSharedMaxAge := directives.seconds("s-maxage"); !hasSharedMaxAge {
+			return false
+		}
+	}
+
+	_, hasMaxAge := directives.seconds("max-age")
+	hasExplicitFreshness := hasMaxAge || response.Header.Get("Expires") != ""
+
+	if hasExplicitFreshness && response.StatusCode != http.StatusPartialContent {
+		return true
+	}
+
+	if !heuristicallyCacheableStatuses[response.StatusCode] {
+		return false
+	}
+
+	return response.Header.Get("ETag") != "" || response.Header.Get("Last-Modified") != ""
+}
+
+type cacheEntry struct {
+	StatusCode   int               `json:"status_code"`
+	Status       string            `json:"status"`
+	Proto        string            `json:"proto"`
+	Header       http.Header       `json:"header"`
+	Body         []byte            `json:"body"`
+	Vary         map[string]string `json:"vary,omitempty"`
+	RequestTime  time.Time         `json:"request_time"`
+	ResponseTime time.Time         `json:"response_time"`
+}
+
+func newCacheEntry(request *http.Request, response *http.Response, body []byte, requestTime, responseTime time.Time) *cacheEntry {
+	entry := &cacheEntry{
+		StatusCode:   response.StatusCode,
+		Status:       response.Status,
+		Proto:        response.Proto,
+		Header:       response.Header.Clone(),
+		Body:         body,
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	entry.Header.Del(CacheStatusHeader)
+
+	for _, name := range headerTokens(response.Header, "Vary") {
+		if entry.Vary == nil {
+			entry.Vary = map[string]string{}
+		}
+
+		entry.Vary[http.CanonicalHeaderKey(name)] = strings.Join(request.Header.Values(name), ", ")
+	}
+
+	return entry
+}
+
+func (e *cacheEntry) varyMatches(request *http.Request) bool {
+	for name, value := range e.Vary {
+		if strings.Join(request.Header.Values(name), ", ") != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (e *cacheEntry) hasValidators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// update refreshes the entry with the headers of a `304 Not Modified` response.
+func (e *cacheEntry) update(header http.Header, requestTime, responseTime time.Time) {
+	for name, values := range header {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", CacheStatusHeader:
+			continue
+		}
+
+		e.Header[name] = values
+	}
+
+	e.RequestTime = requestTime
+	e.ResponseTime = responseTime
+}
+
+// freshnessLifetime computes the entry's freshness lifetime as defined by RFC 9111 (section 4.2.1).
+func (e *cacheEntry) freshnessLifetime() time.Duration {
+	directives := parseCacheControl(e.Header)
+	if directives.has("no-cache") {
+		return 0
+	}
+
+	if maxAge, ok := directives.seconds("max-age"); ok {
+		return maxAge
+	}
+
+	date := e.date()
+	if expiresValue := e.Header.Get("Expires"); expiresValue != "" {
+		expires, err := http.ParseTime(expiresValue)
+		if err != nil {
+			return 0
+		}
+
+		return expires.Sub(date)
+	}
+
+	if lastModified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && heuristicallyCacheableStatuses[e.StatusCode] {
+		lifetime := date.Sub(lastModified) / 10
+		if lifetime > maxHeuristicFreshness {
+			lifetime = maxHeuristicFreshness
+		}
+
+		return lifetime
+	}
+
+	return 0
+}
+
+// age computes the entry's current age as defined by RFC 9111 (section 4.2.3).
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparentAge := e.ResponseTime.Sub(e.date())
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+
+	correctedAge := e.ResponseTime.Sub(e.RequestTime)
+	if ageValue, err := strconv.ParseInt(strings.TrimSpace(e.Header.Get("Age")), 10, 64); err == nil && ageValue > 0 {
+		correctedAge += time.Duration(ageValue) * time.Second
+	}
+
+	if apparentAge > correctedAge {
+		correctedAge = apparentAge
+	}
+
+	return correctedAge + now.Sub(e.ResponseTime)
+}
+
+func (e *cacheEntry) date() time.Time {
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return date
+	}
+
+	return e.ResponseTime
+}
+
+func (e *cacheEntry) toResponse(request *http.Request, cacheStatus string, now time.Time) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+	header.Set(CacheStatusHeader, cacheStatus)
+
+	proto := e.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	protoMajor, protoMinor, _ := http.ParseHTTPVersion(proto)
+
+	return &http.Response{
+		Status:        e.Status,
+		StatusCode:    e.StatusCode,
+		Proto:         proto,
+		ProtoMajor:    protoMajor,
+		ProtoMinor:    protoMinor,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       request,
+	}
+}
+
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	directives := cacheControl{}
+	for _, directive := range headerTokens(header, "Cache-Control") {
+		name, value, _ := strings.Cut(directive, "=")
+		directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+
+	return directives
+}
+
+func (c cacheControl) has(directive string) bool {
+	_, found := c[directive]
+	return found
+}
+
+func (c cacheControl) seconds(directive string) (time.Duration, bool) {
+	value, found := c[directive]
+	if !found {
+		return 0, false
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+
+	return time.Duration(seconds) * time.Second, true
+}
+
+// headerTokens splits the comma separated values of all the `name` header lines.
+func headerTokens(header http.Header, name string) (out []string) {
+	for _, value := range header.Values(name) {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				out = append(out, token)
+			}
+		}
+	}
+
+	return
+}
+
+func hasConditionalHeaders(header http.Header) bool {
+	return header.Get("If-None-Match") != "" || header.Get("If-Modified-Since") != "" ||
+		header.Get("If-Match") != "" || header.Get("If-Unmodified-Since") != "" || header.Get("If-Range") != ""
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions || method == http.MethodTrace
+}
+
+func cacheKey(request *http.Request) string {
+	return fmt.Sprintf("GET %s", request.URL.String())
+}
+
+func gatewayTimeoutResponse(request *http.Request) *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", http.StatusGatewayTimeout, http.StatusText(http.StatusGatewayTimeout)),
+		StatusCode: http.StatusGatewayTimeout,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{CacheStatusHeader: []string{CacheMiss}},
+		Body:       http.NoBody,
+		Request:    request,
+	}
+}
+
+// readLimitedBody reads the response body up to `limit` bytes. When the body fits, it's
+// returned and `complete` is true. In all cases, the response body is replaced so that
+// the caller still receives the full body.
+func readLimitedBody(response *http.Response, limit int64) (body []byte, complete bool, err error) {
+	if response.ContentLength > limit {
+		return nil, false, nil
+	}
+
+	body, err = io.ReadAll(io.LimitReader(response.Body, limit+1))
+	if err != nil {
+		response.Body.Close()
+		return nil, false, fmt.Errorf("unable to read response body: %w", err)
+	}
+
+	if int64(len(body)) > limit {
+		response.Body = &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(body), response.Body), Closer: response.Body}
+		return nil, false, nil
+	}
+
+	response.Body.Close()
+	response.Body = io.NopCloser(bytes.NewReader(body))
+
+	return body, true, nil
+}
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
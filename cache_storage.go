@@ -0,0 +1,156 @@
+package dhttp
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// CacheStorage stores serialized responses for a `CachingRoundTripper`, implementations
+// must be safe for concurrent use.
+type CacheStorage interface {
+	Get(key string) (value []byte, found bool)
+	Set(key string, value []byte)
+	Delete(key string)
+}
+
+// MemoryCacheStorage is an in-memory `CacheStorage` evicting the least recently used
+// entries once the total size of the stored values exceeds its byte budget.
+type MemoryCacheStorage struct {
+	lock     sync.Mutex
+	maxBytes int64
+	size     int64
+	lru      *list.List
+	items    map[string]*list.Element
+}
+
+type memoryCacheItem struct {
+	key   string
+	value []byte
+}
+
+// NewMemoryCacheStorage creates a `MemoryCacheStorage` holding at most `maxBytes`
+// bytes of values, a value bigger than `maxBytes` is never stored.
+func NewMemoryCacheStorage(maxBytes int64) *MemoryCacheStorage {
+	return &MemoryCacheStorage{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+func (s *MemoryCacheStorage) Get(key string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	element, found := s.items[key]
+	if !found {
+		return nil, false
+	}
+
+	s.lru.MoveToFront(element)
+	return element.Value.(*memoryCacheItem).value, true
+}
+
+func (s *MemoryCacheStorage) Set(key string, value []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.remove(key)
+	if int64(len(value)) > s.maxBytes {
+		return
+	}
+
+	s.items[key] = s.lru.PushFront(&memoryCacheItem{key: key, value: value})
+	s.size += int64(len(value))
+
+	for s.size > s.maxBytes {
+		s.remove(s.lru.Back().Value.(*memoryCacheItem).key)
+	}
+}
+
+func (s *MemoryCacheStorage) Delete(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.remove(key)
+}
+
+func (s *MemoryCacheStorage) remove(key string) {
+	element, found := s.items[key]
+	if !found {
+		return
+	}
+
+	s.lru.Remove(element)
+	delete(s.items, key)
+	s.size -= int64(len(element.Value.(*memoryCacheItem).value))
+}
+
+// DiskCacheStorage is a `CacheStorage` storing each value in its own file inside a
+// directory, files are named after the SHA-256 hash of the key. There is no eviction,
+// the directory grows until cleaned externally.
+type DiskCacheStorage struct {
+	directory string
+}
+
+// NewDiskCacheStorage creates a `DiskCacheStorage` storing values in `directory`,
+// creating it if it does not exist.
+func NewDiskCacheStorage(directory string) (*DiskCacheStorage, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+
+	return &DiskCacheStorage{directory: directory}, nil
+}
+
+func (s *DiskCacheStorage) Get(key string) ([]byte, bool) {
+	value, err := os.ReadFile(s.path(key))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			zlog.Debug("unable to read disk cache entry", zap.String("key", key), zap.Error(err))
+		}
+
+		return nil, false
+	}
+
+	return value, true
+}
+
+func (s *DiskCacheStorage) Set(key string, value []byte) {
+	tmpFile, err := os.CreateTemp(s.directory, ".tmp-*")
+	if err != nil {
+		zlog.Debug("unable to create disk cache entry", zap.String("key", key), zap.Error(err))
+		return
+	}
+
+	_, err = tmpFile.Write(value)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), s.path(key))
+	}
+
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		zlog.Debug("unable to write disk cache entry", zap.String("key", key), zap.Error(err))
+	}
+}
+
+func (s *DiskCacheStorage) Delete(key string) {
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		zlog.Debug("unable to delete disk cache entry", zap.String("key", key), zap.Error(err))
+	}
+}
+
+func (s *DiskCacheStorage) path(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(s.directory, hex.EncodeToString(hash[:]))
+}
@@ -0,0 +1,180 @@
+package dhttp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachingRoundTripper(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+
+		switch r.URL.Path {
+		case "/max-age":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store, max-age=60")
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/public":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+		}
+
+		w.Write([]byte("body " + r.URL.Path + " " + r.Header.Get("Accept-Language")))
+	}))
+	defer server.Close()
+
+	type step struct {
+		path           string
+		method         string
+		header         http.Header
+		expectedStatus string
+		expectedBody   string
+		expectedCalls  int32
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"max-age", []step{
+			{"/max-age", "GET", nil, CacheMiss, "body /max-age ", 1},
+			{"/max-age", "GET", nil, CacheHit, "body /max-age ", 1},
+			{"/max-age", "GET", http.Header{"Cache-Control": []string{"no-cache"}}, CacheMiss, "body /max-age ", 2},
+		}},
+		{"no-store", []step{
+			{"/no-store", "GET", nil, CacheMiss, "body /no-store ", 1},
+			{"/no-store", "GET", nil, CacheMiss, "body /no-store ", 2},
+		}},
+		{"etag revalidation", []step{
+			{"/etag", "GET", nil, CacheMiss, "body /etag ", 1},
+			{"/etag", "GET", nil, CacheRevalidated, "body /etag ", 2},
+		}},
+		{"vary", []step{
+			{"/vary", "GET", http.Header{"Accept-Language": []string{"fr"}}, CacheMiss, "body /vary fr", 1},
+			{"/vary", "GET", http.Header{"Accept-Language": []string{"fr"}}, CacheHit, "body /vary fr", 1},
+			{"/vary", "GET", http.Header{"Accept-Language": []string{"en"}}, CacheMiss, "body /vary en", 2},
+		}},
+		{"unsafe invalidates", []step{
+			{"/max-age", "GET", nil, CacheMiss, "body /max-age ", 1},
+			{"/max-age", "POST", nil, CacheMiss, "body /max-age ", 2},
+			{"/max-age", "GET", nil, CacheMiss, "body /max-age ", 3},
+		}},
+		{"authorization not stored", []step{
+			{"/max-age", "GET", http.Header{"Authorization": []string{"Bearer alice"}}, CacheMiss, "body /max-age ", 1},
+			{"/max-age", "GET", http.Header{"Authorization": []string{"Bearer bob"}}, CacheMiss, "body /max-age ", 2},
+		}},
+		{"authorization public stored", []step{
+			{"/public", "GET", http.Header{"Authorization": []string{"Bearer alice"}}, CacheMiss, "body /public ", 1},
+			{"/public", "GET", http.Header{"Authorization": []string{"Bearer bob"}}, CacheHit, "body /public ", 1},
+		}},
+		{"only-if-cached", []step{
+			{"/max-age", "GET", http.Header{"Cache-Control": []string{"only-if-cached"}}, CacheMiss, "", 0},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			atomic.StoreInt32(&calls, 0)
+			client := &http.Client{Transport: NewCachingRoundTripper(NewMemoryCacheStorage(1024*1024), nil)}
+
+			for i, step := range test.steps {
+				request, _ := http.NewRequest(step.method, server.URL+step.path, nil)
+				for key, values := range step.header {
+					request.Header[key] = values
+				}
+
+				response, err := client.Do(request)
+				require.NoError(t, err)
+				body, _ := io.ReadAll(response.Body)
+				response.Body.Close()
+
+				assert.Equal(t, step.expectedStatus, response.Header.Get(CacheStatusHeader), "step %d", i)
+				assert.Equal(t, step.expectedBody, string(body), "step %d", i)
+				assert.Equal(t, step.expectedCalls, atomic.LoadInt32(&calls), "step %d", i)
+			}
+		})
+	}
+}
+
+func TestCachingRoundTripper_Expiration(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	calls := 0
+
+	transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		calls++
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{"Cache-Control": []string{"max-age=10"}},
+			Body:       io.NopCloser(io.LimitReader(neverEnding('a'), 4)),
+		}, nil
+	})
+
+	cache := NewCachingRoundTripper(NewMemoryCacheStorage(1024), transport)
+	cache.now = func() time.Time { return now }
+
+	roundTrip := func() *http.Response {
+		request, _ := http.NewRequest("GET", "http://upstream/", nil)
+		response, err := cache.RoundTrip(request)
+		require.NoError(t, err)
+		io.ReadAll(response.Body)
+		return response
+	}
+
+	roundTrip()
+	now = now.Add(5 * time.Second)
+	response := roundTrip()
+	assert.Equal(t, CacheHit, response.Header.Get(CacheStatusHeader))
+	assert.Equal(t, "5", response.Header.Get("Age"))
+	assert.Equal(t, 1, calls)
+
+	now = now.Add(5 * time.Second)
+	response = roundTrip()
+	assert.Equal(t, CacheMiss, response.Header.Get(CacheStatusHeader))
+	assert.Equal(t, 2, calls)
+}
+
+func TestMemoryCacheStorage_Eviction(t *testing.T) {
+	storage := NewMemoryCacheStorage(10)
+	storage.Set("a", []byte("12345"))
+	storage.Set("b", []byte("12345"))
+	storage.Get("a")
+	storage.Set("c", []byte("12345"))
+
+	_, found := storage.Get("a")
+	assert.True(t, found)
+	_, found = storage.Get("b")
+	assert.False(t, found, "least recently used entry should have been evicted")
+	_, found = storage.Get("c")
+	assert.True(t, found)
+
+	storage.Set("d", []byte("this value is too big"))
+	_, found = storage.Get("d")
+	assert.False(t, found)
+}
+
+type neverEnding byte
+
+func (b neverEnding) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(b)
+	}
+
+	return len(p), nil
+}
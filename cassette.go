@@ -0,0 +1,349 @@
+package dhttp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// ErrCassetteUnmatched is returned (wrapped) by a strict `CassetteRoundTripper` when no
+// recorded interaction matches a request.
+var ErrCassetteUnmatched = errors.New("no recorded interaction matches request")
+
+type CassetteMode int
+
+const (
+	// CassetteModeReplay replays recorded interactions only, the cassette file must exist.
+	CassetteModeReplay CassetteMode = iota
+
+	// CassetteModeRecord performs every request against the actual transport and records
+	// all interactions, replacing any existing cassette content.
+	CassetteModeRecord
+
+	// CassetteModeAppend replays recorded interactions and records the unmatched ones,
+	// appending them to the cassette.
+	CassetteModeAppend
+)
+
+// CassetteMatcher decides if a recorded request matches the actual request, `body` is the
+// actual request's body already read.
+type CassetteMatcher = func(r *http.Request, body []byte, recorded *CassetteRequest) bool
+
+// MatchMethod matches requests with the same HTTP method.
+func MatchMethod(r *http.Request, body []byte, recorded *CassetteRequest) bool {
+	return r.Method == recorded.Method
+}
+
+// MatchURL matches requests with the same full URL, query string included.
+func MatchURL(r *http.Request, body []byte, recorded *CassetteRequest) bool {
+	return r.URL.String() == recorded.URL
+}
+
+// MatchBodyHash matches requests with the same body, compared through its SHA-256 hash.
+func MatchBodyHash(r *http.Request, body []byte, recorded *CassetteRequest) bool {
+	return ContentDigest(body) == recorded.BodyHash
+}
+
+type CassetteOption func(t *CassetteRoundTripper)
+
+// CassetteMatchers sets the matchers that must all match for a recorded interaction to
+// be replayed, defaults to `MatchMethod` and `MatchURL`.
+func CassetteMatchers(matchers ...CassetteMatcher) CassetteOption {
+	return func(t *CassetteRoundTripper) {
+		t.matchers = matchers
+	}
+}
+
+// CassetteStrict makes a replaying cassette fail with `ErrCassetteUnmatched` on unmatched
+// requests instead of forwarding them to the actual transport (without recording them).
+// Enabled by default.
+func CassetteStrict(strict bool) CassetteOption {
+	return func(t *CassetteRoundTripper) {
+		t.strict = strict
+	}
+}
+
+// CassetteRedactHeaders adds headers to redact from recorded interactions on top of
+// `DefaultRedactedHeaders`.
+func CassetteRedactHeaders(headers ...string) CassetteOption {
+	return func(t *CassetteRoundTripper) {
+		t.redactedHeaders = append(t.redactedHeaders, headers...)
+	}
+}
+
+type Cassette struct {
+	Interactions []*CassetteInteraction `json:"interactions"`
+}
+
+type CassetteInteraction struct {
+	Request  *CassetteRequest  `json:"request"`
+	Response *CassetteResponse `json:"response"`
+
+	replayed bool
+}
+
+type CassetteRequest struct {
+	Method       string      `json:"method"`
+	URL          string      `json:"url"`
+	Header       http.Header `json:"header,omitempty"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"body_encoding,omitempty"`
+	BodyHash     string      `json:"body_hash"`
+}
+
+type CassetteResponse struct {
+	StatusCode   int         `json:"status_code"`
+	Header       http.Header `json:"header,omitempty"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"body_encoding,omitempty"`
+}
+
+// NewCassetteRoundTripper creates an `http.RoundTripper` recording request/response pairs
+// to the cassette file at `path` and replaying them, see `CassetteMode` for the different
+// modes. Headers in `DefaultRedactedHeaders` (and those added with `CassetteRedactHeaders`)
+// are redacted before being written to the cassette.
+//
+// It's meant to be used in tests to avoid having to spin up `httptest` servers by hand,
+// record once against a real upstream then commit the cassette and replay it:
+//
+//	transport, err := NewCassetteRoundTripper("testdata/upstream.json", CassetteModeReplay, nil)
+//
+// If the received `next` argument is set as `nil`, the `http.DefaultTransport` value
+// will be used as the actual transport handler when recording.
+func NewCassetteRoundTripper(path string, mode CassetteMode, next http.RoundTripper, opts ...CassetteOption) (*CassetteRoundTripper, error) {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	t := &CassetteRoundTripper{
+		path:            path,
+		mode:            mode,
+		transport:       next,
+		matchers:        []CassetteMatcher{MatchMethod, MatchURL},
+		strict:          true,
+		redactedHeaders: append([]string(nil), DefaultRedactedHeaders...),
+		cassette:        &Cassette{},
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	if mode == CassetteModeRecord {
+		return t, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if mode == CassetteModeAppend && os.IsNotExist(err) {
+			return t, nil
+		}
+
+		return nil, fmt.Errorf("unable to read cassette %q: %w", path, err)
+	}
+
+	if err := json.Unmarshal(content, t.cassette); err != nil {
+		return nil, fmt.Errorf("unable to decode cassette %q: %w", path, err)
+	}
+
+	return t, nil
+}
+
+type CassetteRoundTripper struct {
+	path            string
+	mode            CassetteMode
+	transport       http.RoundTripper
+	matchers        []CassetteMatcher
+	strict          bool
+	redactedHeaders []string
+
+	lock     sync.Mutex
+	cassette *Cassette
+}
+
+func (t *CassetteRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	body, request, err := readRequestBody(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.mode != CassetteModeRecord {
+		if interaction := t.match(request, body); interaction != nil {
+			return interaction.Response.toResponse(request)
+		}
+
+		if t.mode == CassetteModeReplay {
+			if t.strict {
+				return nil, fmt.Errorf("cassette %q: %s %s: %w", t.path, request.Method, request.URL.String(), ErrCassetteUnmatched)
+			}
+
+			return t.transport.RoundTrip(request)
+		}
+	}
+
+	response, err := t.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	responseBody, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response body to record: %w", err)
+	}
+	response.Body = io.NopCloser(bytes.NewReader(responseBody))
+
+	if err := t.record(request, body, response, responseBody); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func (t *CassetteRoundTripper) match(request *http.Request, body []byte) *CassetteInteraction {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// Interactions are replayed in order, once all matching interactions have been
+	// replayed, the last one is replayed again.
+	var lastMatch *CassetteInteraction
+	for _, interaction := range t.cassette.Interactions {
+		if !t.matches(request, body, interaction.Request) {
+			continue
+		}
+
+		if !interaction.replayed {
+			interaction.replayed = true
+			return interaction
+		}
+
+		lastMatch = interaction
+	}
+
+	return lastMatch
+}
+
+func (t *CassetteRoundTripper) matches(request *http.Request, body []byte, recorded *CassetteRequest) bool {
+	for _, matcher := range t.matchers {
+		if !matcher(request, body, recorded) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (t *CassetteRoundTripper) record(request *http.Request, requestBody []byte, response *http.Response, responseBody []byte) error {
+	interaction := &CassetteInteraction{
+		Request: &CassetteRequest{
+			Method:   request.Method,
+			URL:      request.URL.String(),
+			Header:   redactHeaders(request.Header, t.redactedHeaders),
+			BodyHash: ContentDigest(requestBody),
+		},
+		Response: &CassetteResponse{
+			StatusCode: response.StatusCode,
+			Header:     redactHeaders(response.Header, t.redactedHeaders),
+		},
+		replayed: true,
+	}
+
+	interaction.Request.Body, interaction.Request.BodyEncoding = encodeBody(requestBody)
+	interaction.Response.Body, interaction.Response.BodyEncoding = encodeBody(responseBody)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.cassette.Interactions = append(t.cassette.Interactions, interaction)
+
+	return t.save()
+}
+
+// save writes the cassette to disk atomically, the lock must be held by the caller.
+func (t *CassetteRoundTripper) save() error {
+	content, err := json.MarshalIndent(t.cassette, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode cassette %q: %w", t.path, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(t.path), 0755); err != nil {
+		return fmt.Errorf("unable to create cassette %q directory: %w", t.path, err)
+	}
+
+	tmpPath := t.path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0644); err != nil {
+		return fmt.Errorf("unable to write cassette %q: %w", t.path, err)
+	}
+
+	if err := os.Rename(tmpPath, t.path); err != nil {
+		return fmt.Errorf("unable to write cassette %q: %w", t.path, err)
+	}
+
+	return nil
+}
+
+func (r *CassetteResponse) toResponse(request *http.Request) (*http.Response, error) {
+	body, err := decodeBody(r.Body, r.BodyEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode recorded response body: %w", err)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.StatusCode, http.StatusText(r.StatusCode)),
+		StatusCode:    r.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        r.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       request,
+	}, nil
+}
+
+// readRequestBody reads the request's body fully and returns it along a copy of the
+// request with an in-memory body so that it can still be sent.
+func readRequestBody(request *http.Request) ([]byte, *http.Request, error) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil, request, nil
+	}
+
+	body, err := io.ReadAll(request.Body)
+	request.Body.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read request body: %w", err)
+	}
+
+	request = request.Clone(request.Context())
+	request.Body = io.NopCloser(bytes.NewReader(body))
+
+	return body, request, nil
+}
+
+func encodeBody(body []byte) (content string, encoding string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func decodeBody(content string, encoding string) ([]byte, error) {
+	switch strings.ToLower(encoding) {
+	case "":
+		return []byte(content), nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(content)
+	default:
+		return nil, fmt.Errorf("unknown body encoding %q", encoding)
+	}
+}
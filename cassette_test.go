@@ -0,0 +1,96 @@
+package dhttp
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCassetteRoundTripper(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Write([]byte(r.URL.Path + ":" + string(body)))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "cassette.json")
+
+	get := func(transport http.RoundTripper, path string, body string) (string, error) {
+		request, _ := http.NewRequest("POST", server.URL+path, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer secret")
+
+		response, err := transport.RoundTrip(request)
+		if err != nil {
+			return "", err
+		}
+		defer response.Body.Close()
+
+		content, err := io.ReadAll(response.Body)
+		return string(content), err
+	}
+
+	recorder, err := NewCassetteRoundTripper(path, CassetteModeRecord, nil)
+	require.NoError(t, err)
+
+	out, err := get(recorder, "/a", "1")
+	require.NoError(t, err)
+	assert.Equal(t, "/a:1", out)
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), "secret")
+
+	server.Close()
+
+	t.Run("replay", func(t *testing.T) {
+		replayer, err := NewCassetteRoundTripper(path, CassetteModeReplay, nil)
+		require.NoError(t, err)
+
+		out, err := get(replayer, "/a", "1")
+		require.NoError(t, err)
+		assert.Equal(t, "/a:1", out)
+
+		_, err = get(replayer, "/b", "1")
+		assert.True(t, errors.Is(err, ErrCassetteUnmatched))
+	})
+
+	t.Run("body hash matcher", func(t *testing.T) {
+		replayer, err := NewCassetteRoundTripper(path, CassetteModeReplay, nil, CassetteMatchers(MatchMethod, MatchURL, MatchBodyHash))
+		require.NoError(t, err)
+
+		_, err = get(replayer, "/a", "2")
+		assert.True(t, errors.Is(err, ErrCassetteUnmatched))
+	})
+
+	t.Run("append", func(t *testing.T) {
+		appendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("appended"))
+		}))
+		defer appendServer.Close()
+
+		appender, err := NewCassetteRoundTripper(path, CassetteModeAppend, nil)
+		require.NoError(t, err)
+
+		out, err := get(appender, "/a", "1")
+		require.NoError(t, err)
+		assert.Equal(t, "/a:1", out)
+
+		request, _ := http.NewRequest("GET", appendServer.URL+"/c", nil)
+		response, err := appender.RoundTrip(request)
+		require.NoError(t, err)
+		response.Body.Close()
+
+		replayer, err := NewCassetteRoundTripper(path, CassetteModeReplay, nil)
+		require.NoError(t, err)
+		assert.Len(t, replayer.cassette.Interactions, 2)
+	})
+}
@@ -0,0 +1,439 @@
+package dhttp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/streamingfast/derr"
+	"github.com/streamingfast/logging"
+	"go.uber.org/zap"
+)
+
+// CircuitOpenErrorCode is the `derr.ErrorCode` of the error returned by a
+// `CircuitBreakerRoundTripper` when the circuit of the request's host is open.
+const CircuitOpenErrorCode derr.ErrorCode = "circuit_open_error"
+
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// CircuitStateChangeHook is invoked each time the circuit of a host changes state.
+type CircuitStateChangeHook = func(ctx context.Context, host string, from CircuitState, to CircuitState)
+
+type CircuitBreakerOption func(t *CircuitBreakerRoundTripper)
+
+// CircuitBreakerWindow sets the rolling window over which failures are counted as well
+// as the number of buckets the window is split into, defaults to 10s split in 10 buckets.
+func CircuitBreakerWindow(window time.Duration, buckets int) CircuitBreakerOption {
+	return func(t *CircuitBreakerRoundTripper) {
+		t.window = window
+		t.buckets = buckets
+	}
+}
+
+// CircuitBreakerThreshold sets the failure ratio (between 0 and 1) over the rolling window
+// that opens the circuit, the circuit opens only if at least `minRequests` requests were
+// performed in the window. Defaults to a ratio of 0.5 over at least 20 requests.
+func CircuitBreakerThreshold(failureRatio float64, minRequests int) CircuitBreakerOption {
+	return func(t *CircuitBreakerRoundTripper) {
+		t.failureRatio = failureRatio
+		t.minRequests = minRequests
+	}
+}
+
+// CircuitBreakerOpenDuration sets for how long the circuit stays open before letting
+// half-open probe requests through, defaults to 30s.
+func CircuitBreakerOpenDuration(duration time.Duration) CircuitBreakerOption {
+	return func(t *CircuitBreakerRoundTripper) {
+		t.openDuration = duration
+	}
+}
+
+// CircuitBreakerHalfOpenProbes sets the number of concurrent probe requests let through
+// while half-open, all of them must succeed for the circuit to close. Defaults to 1.
+func CircuitBreakerHalfOpenProbes(probes int) CircuitBreakerOption {
+	return func(t *CircuitBreakerRoundTripper) {
+		t.halfOpenProbes = probes
+	}
+}
+
+// CircuitBreakerIsFailure sets the function deciding if the outcome of a request counts
+// as a failure, by default transport errors and 5xx responses are failures. Requests
+// cancelled by the caller are never recorded, be it as a failure or a success.
+func CircuitBreakerIsFailure(isFailure func(response *http.Response, err error) bool) CircuitBreakerOption {
+	return func(t *CircuitBreakerRoundTripper) {
+		t.isFailure = isFailure
+	}
+}
+
+// CircuitBreakerOnStateChange adds a hook invoked on each state change, hooks are
+// invoked synchronously so they should not block.
+func CircuitBreakerOnStateChange(hook CircuitStateChangeHook) CircuitBreakerOption {
+	return func(t *CircuitBreakerRoundTripper) {
+		t.hooks = append(t.hooks, hook)
+	}
+}
+
+// CircuitBreakerLogger sets the logger used to log state changes, the request specific
+// logger is used if one exists in the request's context. Pass the same logger as the one
+// given to `NewLoggingRoundTripper` to have everything in the same place.
+func CircuitBreakerLogger(logger *zap.Logger) CircuitBreakerOption {
+	return func(t *CircuitBreakerRoundTripper) {
+		t.logger = logger
+	}
+}
+
+// NewCircuitBreakerRoundTripper creates a wrapping `http.RoundTripper` that tracks the
+// failure rate of each upstream host (`Request.URL.Host`) and stops sending requests
+// to a host once its failure rate is over the configured threshold.
+//
+// While the circuit of a host is open, requests fail right away with a `derr` 503
+// error of code `CircuitOpenErrorCode` which can be written back as-is with `WriteError`.
+// Once the open duration elapsed, the circuit becomes half-open and a limited number of
+// probe requests are let through, closing the circuit if they all succeed or re-opening
+// it on the first failure.
+//
+// If the received `next` argument is set as `nil`, the `http.DefaultTransport` value
+// will be used as the actual transport handler.
+func NewCircuitBreakerRoundTripper(next http.RoundTripper, opts ...CircuitBreakerOption) *CircuitBreakerRoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	t := &CircuitBreakerRoundTripper{
+		transport:      next,
+		logger:         zlog,
+		window:         10 * time.Second,
+		buckets:        10,
+		failureRatio:   0.5,
+		minRequests:    20,
+		openDuration:   30 * time.Second,
+		halfOpenProbes: 1,
+		isFailure:      defaultIsFailure,
+		now:            time.Now,
+		circuits:       map[string]*hostCircuit{},
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	if t.buckets <= 0 {
+		t.buckets = 1
+	}
+
+	if t.halfOpenProbes <= 0 {
+		t.halfOpenProbes = 1
+	}
+
+	return t
+}
+
+type CircuitBreakerRoundTripper struct {
+	transport      http.RoundTripper
+	logger         *zap.Logger
+	window         time.Duration
+	buckets        int
+	failureRatio   float64
+	minRequests    int
+	openDuration   time.Duration
+	halfOpenProbes int
+	isFailure      func(response *http.Response, err error) bool
+	hooks          []CircuitStateChangeHook
+	now            func() time.Time
+
+	lock      sync.Mutex
+	circuits  map[string]*hostCircuit
+	lastPurge time.Time
+}
+
+// State returns the current state of the circuit for the given host, hosts never
+// requested have a closed circuit.
+func (t *CircuitBreakerRoundTripper) State(host string) CircuitState {
+	t.lock.Lock()
+	circuit, found := t.circuits[host]
+	t.lock.Unlock()
+
+	if !found {
+		return CircuitClosed
+	}
+
+	circuit.lock.Lock()
+	defer circuit.lock.Unlock()
+
+	return circuit.state
+}
+
+func (t *CircuitBreakerRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	ctx := request.Context()
+	host := request.URL.Host
+	circuit := t.circuit(host)
+
+	ticket, allowed, transition := circuit.allow(t.now())
+	t.notify(ctx, host, transition)
+
+	if !allowed {
+		return nil, derr.HTTPServiceUnavailableError(ctx, fmt.Errorf("circuit open for host %q", host), CircuitOpenErrorCode, "The service you are requesting is temporarily unavailable.")
+	}
+
+	response, err := t.transport.RoundTrip(request)
+	if err != nil && classifyTransportError(err) == transportErrorCancelled {
+		// The caller gave up, it says nothing about the health of the host
+		circuit.release(ticket)
+		return response, err
+	}
+
+	transition = circuit.record(t.now(), ticket, t.isFailure(response, err))
+	t.notify(ctx, host, transition)
+
+	return response, err
+}
+
+func (t *CircuitBreakerRoundTripper) circuit(host string) *hostCircuit {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := t.now()
+	if now.Sub(t.lastPurge) > t.window {
+		t.purgeIdleCircuits(now)
+		t.lastPurge = now
+	}
+
+	circuit, found := t.circuits[host]
+	if !found {
+		circuit = &hostCircuit{
+			config:  t,
+			buckets: make([]circuitBucket, t.buckets),
+		}
+		t.circuits[host] = circuit
+	}
+
+	circuit.lastUsed = now
+	return circuit
+}
+
+// purgeIdleCircuits forgets the closed circuits of hosts not requested for a whole window,
+// they hold no information anymore. Must be called with `t.lock` held.
+func (t *CircuitBreakerRoundTripper) purgeIdleCircuits(now time.Time) {
+	for host, circuit := range t.circuits {
+		if now.Sub(circuit.lastUsed) <= t.window {
+			continue
+		}
+
+		circuit.lock.Lock()
+		idle := circuit.state == CircuitClosed
+		circuit.lock.Unlock()
+
+		if idle {
+			delete(t.circuits, host)
+		}
+	}
+}
+
+func (t *CircuitBreakerRoundTripper) notify(ctx context.Context, host string, transition *circuitTransition) {
+	if transition == nil {
+		return
+	}
+
+	logging.Logger(ctx, t.logger).Info("circuit breaker state changed",
+		zap.String("host", host),
+		zap.Stringer("from", transition.from),
+		zap.Stringer("to", transition.to),
+	)
+
+	for _, hook := range t.hooks {
+		hook(ctx, host, transition.from, transition.to)
+	}
+}
+
+func defaultIsFailure(response *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	return response.StatusCode >= 500
+}
+
+type circuitTransition struct {
+	from CircuitState
+	to   CircuitState
+}
+
+type circuitBucket struct {
+	start    time.Time
+	requests int
+	failures int
+}
+
+type hostCircuit struct {
+	config *CircuitBreakerRoundTripper
+
+	// lastUsed is protected by the round tripper's lock
+	lastUsed time.Time
+
+	lock            sync.Mutex
+	state           CircuitState
+	generation      uint64
+	openedAt        time.Time
+	buckets         []circuitBucket
+	probesInFlight  int
+	probesSucceeded int
+}
+
+// circuitTicket identifies a request let through by a circuit, probes are tied to the
+// half-open period they were let through in.
+type circuitTicket struct {
+	probe      bool
+	generation uint64
+}
+
+// allow returns whether the request can go through and the ticket to record its outcome with
+func (c *hostCircuit) allow(now time.Time) (ticket circuitTicket, allowed bool, transition *circuitTransition) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.state == CircuitOpen {
+		if now.Sub(c.openedAt) < c.config.openDuration {
+			return ticket, false, nil
+		}
+
+		transition = c.transitionTo(CircuitHalfOpen, now)
+	}
+
+	ticket.generation = c.generation
+	if c.state == CircuitHalfOpen {
+		if c.probesInFlight+c.probesSucceeded >= c.config.halfOpenProbes {
+			return ticket, false, transition
+		}
+
+		c.probesInFlight++
+		ticket.probe = true
+		return ticket, true, transition
+	}
+
+	return ticket, true, transition
+}
+
+// release gives back the probe slot of a request whose outcome is not recorded.
+func (c *hostCircuit) release(ticket circuitTicket) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if ticket.probe && ticket.generation == c.generation {
+		c.probesInFlight--
+	}
+}
+
+func (c *hostCircuit) record(now time.Time, ticket circuitTicket, failed bool) *circuitTransition {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if ticket.probe {
+		if ticket.generation != c.generation {
+			// The circuit changed state while the probe was in flight, its outcome is irrelevant now
+			return nil
+		}
+
+		c.probesInFlight--
+		if failed {
+			return c.transitionTo(CircuitOpen, now)
+		}
+
+		c.probesSucceeded++
+		if c.probesSucceeded >= c.config.halfOpenProbes {
+			return c.transitionTo(CircuitClosed, now)
+		}
+
+		return nil
+	}
+
+	if c.state != CircuitClosed {
+		return nil
+	}
+
+	bucket := c.bucket(now)
+	bucket.requests++
+	if failed {
+		bucket.failures++
+	}
+
+	requests, failures := c.totals(now)
+	if requests >= c.config.minRequests && requests > 0 && float64(failures)/float64(requests) >= c.config.failureRatio {
+		return c.transitionTo(CircuitOpen, now)
+	}
+
+	return nil
+}
+
+func (c *hostCircuit) transitionTo(state CircuitState, now time.Time) *circuitTransition {
+	transition := &circuitTransition{from: c.state, to: state}
+
+	c.state = state
+	c.generation++
+	c.probesInFlight = 0
+	c.probesSucceeded = 0
+
+	switch state {
+	case CircuitOpen:
+		c.openedAt = now
+	case CircuitClosed:
+		for i := range c.buckets {
+			c.buckets[i] = circuitBucket{}
+		}
+	}
+
+	return transition
+}
+
+func (c *hostCircuit) bucketDuration() time.Duration {
+	duration := c.config.window / time.Duration(len(c.buckets))
+	if duration <= 0 {
+		return time.Nanosecond
+	}
+
+	return duration
+}
+
+func (c *hostCircuit) bucket(now time.Time) *circuitBucket {
+	bucketDuration := c.bucketDuration()
+	start := now.Truncate(bucketDuration)
+	bucket := &c.buckets[int((start.UnixNano()/int64(bucketDuration))%int64(len(c.buckets)))]
+
+	if !bucket.start.Equal(start) {
+		*bucket = circuitBucket{start: start}
+	}
+
+	return bucket
+}
+
+func (c *hostCircuit) totals(now time.Time) (requests int, failures int) {
+	windowStart := now.Add(-c.config.window)
+	for _, bucket := range c.buckets {
+		if bucket.start.After(windowStart) {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+
+	return
+}
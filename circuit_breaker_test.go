@@ -0,0 +1,160 @@
+package dhttp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/streamingfast/derr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreakerRoundTripper(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	failing := true
+	calls := 0
+
+	transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		calls++
+		if failing {
+			return nil, errors.New("boom")
+		}
+
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	})
+
+	var transitions []string
+	breaker := NewCircuitBreakerRoundTripper(transport,
+		CircuitBreakerThreshold(0.5, 4),
+		CircuitBreakerOpenDuration(time.Minute),
+		CircuitBreakerOnStateChange(func(ctx context.Context, host string, from, to CircuitState) {
+			transitions = append(transitions, host+":"+from.String()+"->"+to.String())
+		}),
+	)
+	breaker.now = func() time.Time { return now }
+
+	roundTrip := func() error {
+		request, _ := http.NewRequest("GET", "http://upstream/", nil)
+		_, err := breaker.RoundTrip(request)
+		return err
+	}
+
+	for i := 0; i < 4; i++ {
+		require.Error(t, roundTrip())
+	}
+	assert.Equal(t, CircuitOpen, breaker.State("upstream"))
+	assert.Equal(t, 4, calls)
+
+	err := roundTrip()
+	var errResponse *derr.ErrorResponse
+	require.True(t, errors.As(err, &errResponse))
+	assert.Equal(t, CircuitOpenErrorCode, errResponse.Code)
+	assert.Equal(t, http.StatusServiceUnavailable, errResponse.Status)
+	assert.Equal(t, 4, calls, "no call should reach upstream while open")
+
+	// Half-open probe fails, circuit re-opens
+	now = now.Add(time.Minute)
+	require.Error(t, roundTrip())
+	assert.Equal(t, CircuitOpen, breaker.State("upstream"))
+
+	// Half-open probe succeeds, circuit closes
+	now = now.Add(time.Minute)
+	failing = false
+	require.NoError(t, roundTrip())
+	assert.Equal(t, CircuitClosed, breaker.State("upstream"))
+	assert.Equal(t, CircuitClosed, breaker.State("other"))
+
+	assert.Equal(t, []string{
+		"upstream:closed->open",
+		"upstream:open->half-open",
+		"upstream:half-open->open",
+		"upstream:open->half-open",
+		"upstream:half-open->closed",
+	}, transitions)
+}
+
+func TestCircuitBreakerRoundTripper_StaleProbe(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	breaker := NewCircuitBreakerRoundTripper(nil, CircuitBreakerOpenDuration(time.Minute), CircuitBreakerHalfOpenProbes(2))
+	circuit := breaker.circuit("upstream")
+	circuit.transitionTo(CircuitOpen, now)
+
+	// A first half-open period lets a probe through which stays in flight
+	now = now.Add(time.Minute)
+	stale, allowed, _ := circuit.allow(now)
+	require.True(t, allowed)
+
+	// Meanwhile, another probe fails and a second half-open period starts
+	failed, allowed, _ := circuit.allow(now)
+	require.True(t, allowed)
+	circuit.record(now, failed, true)
+
+	now = now.Add(time.Minute)
+	probe, allowed, _ := circuit.allow(now)
+	require.True(t, allowed)
+
+	// The stale probe succeeding must not count toward closing the circuit
+	assert.Nil(t, circuit.record(now, stale, false))
+	assert.Equal(t, 1, circuit.probesInFlight)
+	assert.Equal(t, 0, circuit.probesSucceeded)
+
+	circuit.record(now, probe, false)
+	assert.Equal(t, CircuitHalfOpen, breaker.State("upstream"))
+}
+
+func TestCircuitBreakerRoundTripper_PurgeIdleCircuits(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	breaker := NewCircuitBreakerRoundTripper(nil, CircuitBreakerWindow(10*time.Second, 10))
+	breaker.now = func() time.Time { return now }
+
+	breaker.circuit("idle")
+	breaker.circuit("open").transitionTo(CircuitOpen, now)
+
+	now = now.Add(time.Minute)
+	breaker.circuit("active")
+
+	assert.Len(t, breaker.circuits, 2)
+	assert.Contains(t, breaker.circuits, "open")
+	assert.Contains(t, breaker.circuits, "active")
+}
+
+func TestCircuitBreakerRoundTripper_CancelledProbe(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cancelled := true
+	transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if cancelled {
+			return nil, context.Canceled
+		}
+
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	})
+
+	breaker := NewCircuitBreakerRoundTripper(transport, CircuitBreakerOpenDuration(time.Minute))
+	breaker.now = func() time.Time { return now }
+	breaker.circuit("upstream").transitionTo(CircuitOpen, now)
+
+	roundTrip := func() error {
+		request, _ := http.NewRequest("GET", "http://upstream/", nil)
+		_, err := breaker.RoundTrip(request)
+		return err
+	}
+
+	// A cancelled probe neither closes the circuit nor keeps its probe slot
+	now = now.Add(time.Minute)
+	require.ErrorIs(t, roundTrip(), context.Canceled)
+	assert.Equal(t, CircuitHalfOpen, breaker.State("upstream"))
+
+	cancelled = false
+	require.NoError(t, roundTrip())
+	assert.Equal(t, CircuitClosed, breaker.State("upstream"))
+}
+
+func TestCircuitBreakerRoundTripper_StateLookup(t *testing.T) {
+	breaker := NewCircuitBreakerRoundTripper(nil)
+
+	assert.Equal(t, CircuitClosed, breaker.State("unknown"))
+	assert.Empty(t, breaker.circuits)
+}
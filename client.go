@@ -0,0 +1,190 @@
+package dhttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/streamingfast/derr"
+)
+
+// maxErrorBodyBytes is the maximum amount of bytes read from a non-2xx response body
+// when reconstructing the error it represents.
+const maxErrorBodyBytes = 1024 * 1024
+
+type ClientOption func(c *Client)
+
+// ClientHTTPClient sets the `http.Client` used to perform the requests, defaults to
+// `http.DefaultClient`. Use it to configure the transport chain (logging, retrying,
+// tracing, etc.).
+func ClientHTTPClient(httpClient *http.Client) ClientOption {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// ClientHeader adds a header sent with every request performed by the client.
+func ClientHeader(key string, value string) ClientOption {
+	return func(c *Client) {
+		c.headers.Add(key, value)
+	}
+}
+
+// Client is an HTTP client performing JSON requests against a dhttp based service.
+//
+// Success (2xx) responses are decoded as JSON in the received output value while other
+// responses are turned back into a `*derr.ErrorResponse` preserving the code, trace ID,
+// message and details written by `WriteError` upstream, so that the error can be
+// re-surfaced unchanged with `WriteError`.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	headers    http.Header
+}
+
+// NewClient creates a new `Client` performing requests against `baseURL`, request paths
+// are appended to it.
+func NewClient(baseURL string, opts ...ClientOption) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		headers:    http.Header{},
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// GetJSON performs a `GET` request against `path` and decodes the JSON response in `out`.
+func (c *Client) GetJSON(ctx context.Context, path string, out interface{}) error {
+	return c.DoJSON(ctx, http.MethodGet, path, nil, out)
+}
+
+// PostJSON performs a `POST` request against `path` with `in` encoded as JSON as the body
+// and decodes the JSON response in `out`.
+func (c *Client) PostJSON(ctx context.Context, path string, in interface{}, out interface{}) error {
+	return c.DoJSON(ctx, http.MethodPost, path, in, out)
+}
+
+// DoJSON performs a request against `path`, if `in` is not `nil` it's encoded as JSON as
+// the request body and if `out` is not `nil`, the response body is decoded as JSON in it.
+func (c *Client) DoJSON(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	request, err := c.newRequest(ctx, method, path, in)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return transportToError(ctx, request, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return ResponseToError(ctx, response)
+	}
+
+	if out == nil || response.StatusCode == http.StatusNoContent {
+		io.CopyN(io.Discard, response.Body, maxDrainBytes)
+		return nil
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(out); err != nil {
+		return fmt.Errorf("unable to decode %s %s response: %w", method, request.URL.String(), err)
+	}
+
+	return nil
+}
+
+// transportToError turns an error returned by the `http.Client` into the error returned to
+// callers. Cancellation and deadline errors are the caller's doing and are returned as is,
+// so are derr errors produced by round trippers (like `CircuitOpenErrorCode` ones), other
+// errors mean upstream is unavailable.
+func transportToError(ctx context.Context, request *http.Request, err error) error {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	var errorResponse *derr.ErrorResponse
+	if errors.As(err, &errorResponse) {
+		return errorResponse
+	}
+
+	return derr.ServiceUnavailableError(ctx, err, request.URL.Host)
+}
+
+// Do performs a request against `path` like `Client.DoJSON` and decodes the JSON response
+// in a new value of type `T`.
+func Do[T any](ctx context.Context, client *Client, method string, path string, in interface{}) (out T, err error) {
+	err = client.DoJSON(ctx, method, path, in, &out)
+	return
+}
+
+func (c *Client) newRequest(ctx context.Context, method string, path string, in interface{}) (*http.Request, error) {
+	var body io.Reader
+	if in != nil {
+		content, err := json.Marshal(in)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode %s %s request: %w", method, path, err)
+		}
+
+		body = bytes.NewReader(content)
+	}
+
+	url := c.baseURL + path
+	if path != "" && !strings.HasPrefix(path, "/") {
+		url = c.baseURL + "/" + path
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create %s %s request: %w", method, url, err)
+	}
+
+	for key, values := range c.headers {
+		request.Header[key] = append([]string(nil), values...)
+	}
+
+	request.Header.Set("Accept", "application/json")
+	if in != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	return request, nil
+}
+
+// ResponseToError turns a non-2xx response into a `*derr.ErrorResponse`. If the body is
+// a JSON error as written by `WriteError`, the code, trace ID, message and details are
+// preserved, otherwise a generic `upstream_error` of the same status is returned. The
+// response body is read but not closed.
+func ResponseToError(ctx context.Context, response *http.Response) *derr.ErrorResponse {
+	cause := fmt.Errorf("upstream responded with status %d", response.StatusCode)
+	host := ""
+	if response.Request != nil {
+		cause = fmt.Errorf("upstream %s %s responded with status %d", response.Request.Method, response.Request.URL.String(), response.StatusCode)
+		host = response.Request.URL.Host
+	}
+
+	content, err := io.ReadAll(io.LimitReader(response.Body, maxErrorBodyBytes))
+	if err != nil {
+		return derr.ServiceUnavailableError(ctx, fmt.Errorf("%s, unable to read error body: %w", cause, err), host)
+	}
+
+	errResponse := &derr.ErrorResponse{}
+	if err := json.Unmarshal(content, errResponse); err == nil && errResponse.Code != "" {
+		errResponse.Status = response.StatusCode
+		errResponse.Causer = cause
+
+		return errResponse
+	}
+
+	return derr.HTTPErrorFromStatus(response.StatusCode, ctx, fmt.Errorf("%s: %s", cause, content), derr.C("upstream_error"), http.StatusText(response.StatusCode))
+}
@@ -0,0 +1,113 @@
+package dhttp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/streamingfast/derr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type clientTestItem struct {
+	ID string `json:"id"`
+}
+
+func TestClient(t *testing.T) {
+	router := mux.NewRouter()
+	router.Methods("GET").Path("/items/{id}").Handler(JSONHandler(func(r *http.Request) (interface{}, error) {
+		id := mux.Vars(r)["id"]
+		if id == "missing" {
+			return nil, derr.HTTPNotFoundError(r.Context(), nil, derr.C("item_not_found_error"), "The item does not exist.", "id", id)
+		}
+
+		return clientTestItem{ID: id}, nil
+	}))
+	router.Methods("POST").Path("/items").Handler(JSONHandler(func(r *http.Request) (interface{}, error) {
+		item := clientTestItem{}
+		if err := ExtractJSONRequest(r.Context(), r, &item, NoValidation); err != nil {
+			return nil, err
+		}
+
+		return item, nil
+	}))
+	router.Methods("GET").Path("/plain").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusTeapot)
+	})
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	ctx := context.Background()
+	client := NewClient(server.URL)
+
+	t.Run("get", func(t *testing.T) {
+		item := clientTestItem{}
+		require.NoError(t, client.GetJSON(ctx, "/items/abc", &item))
+		assert.Equal(t, clientTestItem{ID: "abc"}, item)
+	})
+
+	t.Run("post generic", func(t *testing.T) {
+		item, err := Do[clientTestItem](ctx, client, "POST", "items", clientTestItem{ID: "def"})
+		require.NoError(t, err)
+		assert.Equal(t, clientTestItem{ID: "def"}, item)
+	})
+
+	t.Run("derr error", func(t *testing.T) {
+		err := client.GetJSON(ctx, "/items/missing", &clientTestItem{})
+
+		var errResponse *derr.ErrorResponse
+		require.True(t, errors.As(err, &errResponse))
+		assert.Equal(t, derr.C("item_not_found_error"), errResponse.Code)
+		assert.Equal(t, http.StatusNotFound, errResponse.Status)
+		assert.Equal(t, "The item does not exist.", errResponse.Message)
+		assert.Equal(t, map[string]interface{}{"id": "missing"}, errResponse.Details)
+		assert.NotEmpty(t, errResponse.TraceID)
+	})
+
+	t.Run("non derr error", func(t *testing.T) {
+		err := client.GetJSON(ctx, "/plain", &clientTestItem{})
+
+		var errResponse *derr.ErrorResponse
+		require.True(t, errors.As(err, &errResponse))
+		assert.Equal(t, derr.C("upstream_error"), errResponse.Code)
+		assert.Equal(t, http.StatusTeapot, errResponse.Status)
+	})
+
+	t.Run("transport error", func(t *testing.T) {
+		err := NewClient("http://127.0.0.1:1").GetJSON(ctx, "/items/abc", &clientTestItem{})
+
+		var errResponse *derr.ErrorResponse
+		require.True(t, errors.As(err, &errResponse))
+		assert.Equal(t, http.StatusBadGateway, errResponse.Status)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		cancelledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		err := client.GetJSON(cancelledCtx, "/items/abc", &clientTestItem{})
+		assert.ErrorIs(t, err, context.Canceled)
+
+		var errResponse *derr.ErrorResponse
+		assert.False(t, errors.As(err, &errResponse))
+	})
+
+	t.Run("round tripper derr error", func(t *testing.T) {
+		breaker := NewCircuitBreakerRoundTripper(nil, CircuitBreakerThreshold(0.5, 1))
+		breaker.circuit(strings.TrimPrefix(server.URL, "http://")).transitionTo(CircuitOpen, time.Now())
+
+		err := NewClient(server.URL, ClientHTTPClient(&http.Client{Transport: breaker})).GetJSON(ctx, "/items/abc", &clientTestItem{})
+
+		var errResponse *derr.ErrorResponse
+		require.True(t, errors.As(err, &errResponse))
+		assert.Equal(t, CircuitOpenErrorCode, errResponse.Code)
+		assert.Equal(t, http.StatusServiceUnavailable, errResponse.Status)
+	})
+}
@@ -0,0 +1,146 @@
+package dhttp
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// clientTimings records the various phases of an outgoing HTTP request through
+// `httptrace` hooks. Hooks can be invoked from different goroutines (dialing
+// happens concurrently with the request in some cases), so every access is
+// guarded by the mutex.
+type clientTimings struct {
+	lock sync.Mutex
+
+	start        time.Time
+	gotConn      time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+	reusedConn   bool
+}
+
+func newClientTimings() *clientTimings {
+	return &clientTimings{start: time.Now()}
+}
+
+func (c *clientTimings) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.record(func() {
+				c.gotConn = time.Now()
+				c.reusedConn = info.Reused
+			})
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			c.record(func() { c.dnsStart = time.Now() })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			c.record(func() { c.dnsDone = time.Now() })
+		},
+		ConnectStart: func(_, _ string) {
+			c.record(func() {
+				// With multiple addresses (e.g. IPv4 and IPv6), dialing happens in parallel, we keep the earliest start
+				if c.connectStart.IsZero() {
+					c.connectStart = time.Now()
+				}
+			})
+		},
+		ConnectDone: func(_, _ string, _ error) {
+			c.record(func() { c.connectDone = time.Now() })
+		},
+		TLSHandshakeStart: func() {
+			c.record(func() { c.tlsStart = time.Now() })
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			c.record(func() { c.tlsDone = time.Now() })
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			c.record(func() { c.wroteRequest = time.Now() })
+		},
+		GotFirstResponseByte: func() {
+			c.record(func() { c.firstByte = time.Now() })
+		},
+	}
+}
+
+func (c *clientTimings) record(fn func()) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	fn()
+}
+
+// elapsed returns the time elapsed since the timings started, it's safe
+// to call on a `nil` receiver in which case 0 is returned.
+func (c *clientTimings) elapsed() time.Duration {
+	if c == nil {
+		return 0
+	}
+
+	return time.Since(c.start)
+}
+
+func (c *clientTimings) timeToFirstByte() time.Duration {
+	if c == nil {
+		return 0
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return between(c.start, c.firstByte)
+}
+
+func (c *clientTimings) dns() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return between(c.dnsStart, c.dnsDone)
+}
+
+func (c *clientTimings) connect() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return between(c.connectStart, c.connectDone)
+}
+
+func (c *clientTimings) tls() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return between(c.tlsStart, c.tlsDone)
+}
+
+func (c *clientTimings) zapFields() []zap.Field {
+	c.lock.Lock()
+	reused := c.reusedConn
+	c.lock.Unlock()
+
+	return []zap.Field{
+		zap.Duration("duration", c.elapsed()),
+		zap.Duration("time_to_first_byte", c.timeToFirstByte()),
+		zap.Duration("dns", c.dns()),
+		zap.Duration("connect", c.connect()),
+		zap.Duration("tls", c.tls()),
+		zap.Bool("reused_conn", reused),
+	}
+}
+
+func between(start, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+
+	return end.Sub(start)
+}
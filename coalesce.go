@@ -0,0 +1,279 @@
+package dhttp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streamingfast/logging"
+	"go.uber.org/zap"
+)
+
+// DefaultCoalesceHeaders are the request headers part of the coalescing key when no
+// `CoalesceHeaders` option is provided. Credentials are part of it so that responses
+// are never shared between different callers.
+var DefaultCoalesceHeaders = []string{
+	"Accept",
+	"Accept-Encoding",
+	"Accept-Language",
+	"Authorization",
+	"Cookie",
+}
+
+type CoalesceOption func(t *CoalescingRoundTripper)
+
+// CoalesceHeaders sets the request headers part of the coalescing key, replacing
+// `DefaultCoalesceHeaders`. Requests differing on other headers are coalesced.
+func CoalesceHeaders(headers ...string) CoalesceOption {
+	return func(t *CoalescingRoundTripper) {
+		t.headers = headers
+	}
+}
+
+// CoalesceMaxBodySize sets the maximum body size of a response that can be shared,
+// defaults to 1 MiB. When the response is bigger, a single waiter receives it and the
+// others perform their own request.
+func CoalesceMaxBodySize(maxBodySize int64) CoalesceOption {
+	return func(t *CoalescingRoundTripper) {
+		t.maxBodySize = maxBodySize
+	}
+}
+
+// CoalesceLogger sets the logger used to log coalesced requests, the request specific
+// logger is used if one exists in the request's context.
+func CoalesceLogger(logger *zap.Logger) CoalesceOption {
+	return func(t *CoalescingRoundTripper) {
+		t.logger = logger
+	}
+}
+
+// NewCoalescingRoundTripper creates a wrapping `http.RoundTripper` collapsing concurrent
+// identical `GET` and `HEAD` requests (same method, URL and values for the headers set
+// through `CoalesceHeaders`) into a single upstream request whose response is fanned out
+// to every waiter, each receiving its own copy of the headers and body.
+//
+// Requests having a `Range`, a conditional (`If-None-Match`, `If-Modified-Since`, etc.) or
+// an `Upgrade` header are never coalesced. The upstream request is cancelled only once all
+// waiters gave up on it. Responses with a body bigger than `CoalesceMaxBodySize` are not
+// shared, see `CoalesceMaxBodySize`.
+//
+// If the received `next` argument is set as `nil`, the `http.DefaultTransport` value
+// will be used as the actual transport handler.
+func NewCoalescingRoundTripper(next http.RoundTripper, opts ...CoalesceOption) *CoalescingRoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	t := &CoalescingRoundTripper{
+		transport:   next,
+		logger:      zlog,
+		headers:     DefaultCoalesceHeaders,
+		maxBodySize: 1024 * 1024,
+		calls:       map[string]*coalescedCall{},
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	return t
+}
+
+type CoalescingRoundTripper struct {
+	transport   http.RoundTripper
+	logger      *zap.Logger
+	headers     []string
+	maxBodySize int64
+
+	lock  sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+type coalescedCall struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+
+	// Guarded by the round tripper's lock
+	waiters int
+
+	response *http.Response
+	body     []byte
+	err      error
+
+	// streamed is set when the response is too big to be shared, the first waiter
+	// claiming it receives it
+	streamed     bool
+	streamedOnce sync.Once
+}
+
+func (t *CoalescingRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	if !isCoalescable(request) {
+		return t.transport.RoundTrip(request)
+	}
+
+	ctx := request.Context()
+	key := t.key(request)
+
+	t.lock.Lock()
+	call, found := t.calls[key]
+	if !found {
+		upstreamCtx, cancel := context.WithCancel(detachedContext{ctx})
+		call = &coalescedCall{done: make(chan struct{}), cancel: cancel}
+		t.calls[key] = call
+
+		go t.execute(key, call, request.Clone(upstreamCtx))
+	}
+	call.waiters++
+	waiters := call.waiters
+	t.lock.Unlock()
+
+	if found {
+		logging.Logger(ctx, t.logger).Debug(fmt.Sprintf("coalescing HTTP request %s %s", request.Method, request.URL.String()), zap.Int("waiters", waiters))
+	}
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		t.leave(call)
+		return nil, ctx.Err()
+	}
+
+	if call.err != nil {
+		return nil, call.err
+	}
+
+	if call.streamed {
+		claimed := false
+		call.streamedOnce.Do(func() { claimed = true })
+		if claimed {
+			return call.response, nil
+		}
+
+		return t.transport.RoundTrip(request)
+	}
+
+	return call.copyResponse(request), nil
+}
+
+// isCoalescable returns whether the response to the request can be shared, partial and
+// conditional responses depend on the caller's headers and upgrades are connections.
+func isCoalescable(request *http.Request) bool {
+	if (request.Method != http.MethodGet && request.Method != http.MethodHead) || (request.Body != nil && request.Body != http.NoBody) {
+		return false
+	}
+
+	return request.Header.Get("Range") == "" && !hasConditionalHeaders(request.Header) && !isUpgradeRequest(request)
+}
+
+func (t *CoalescingRoundTripper) execute(key string, call *coalescedCall, request *http.Request) {
+	response, err := t.transport.RoundTrip(request)
+	if err == nil {
+		var complete bool
+		call.body, complete, err = readLimitedBody(response, t.maxBodySize)
+		call.streamed = err == nil && !complete
+		call.response = response
+	}
+	call.err = err
+
+	if call.streamed {
+		call.response.Body = newCancelOnCloseBody(call.response.Body, call.cancel)
+	} else {
+		call.cancel()
+	}
+
+	// From now on, new identical requests start a new upstream request. The call is marked
+	// done while holding the lock so that `leave` knows who closes an unclaimed response.
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.calls[key] == call {
+		delete(t.calls, key)
+	}
+
+	close(call.done)
+	if call.waiters == 0 {
+		call.closeUnclaimed()
+	}
+}
+
+// leave is invoked when a waiter gave up, the upstream request is cancelled once
+// all waiters left.
+func (t *CoalescingRoundTripper) leave(call *coalescedCall) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	call.waiters--
+	if call.waiters == 0 {
+		call.cancel()
+
+		for key, candidate := range t.calls {
+			if candidate == call {
+				delete(t.calls, key)
+				break
+			}
+		}
+
+		// When the call is still running, `execute` closes the response once done
+		select {
+		case <-call.done:
+			call.closeUnclaimed()
+		default:
+		}
+	}
+}
+
+func (t *CoalescingRoundTripper) key(request *http.Request) string {
+	key := strings.Builder{}
+	key.WriteString(request.Method)
+	key.WriteString(" ")
+	key.WriteString(request.URL.String())
+
+	for _, header := range t.headers {
+		key.WriteString("\n")
+		key.WriteString(http.CanonicalHeaderKey(header))
+		key.WriteString(": ")
+		key.WriteString(strings.Join(request.Header.Values(header), ", "))
+	}
+
+	return key.String()
+}
+
+// closeUnclaimed closes the streamed response if no waiter claimed it, it must be
+// called only once no waiter is left.
+func (c *coalescedCall) closeUnclaimed() {
+	if !c.streamed {
+		return
+	}
+
+	c.streamedOnce.Do(func() { c.response.Body.Close() })
+}
+
+func (c *coalescedCall) copyResponse(request *http.Request) *http.Response {
+	response := *c.response
+	response.Header = c.response.Header.Clone()
+	response.Trailer = c.response.Trailer.Clone()
+	response.Body = io.NopCloser(bytes.NewReader(c.body))
+	response.Request = request
+	if request.Method != http.MethodHead {
+		response.ContentLength = int64(len(c.body))
+	}
+
+	return &response
+}
+
+// detachedContext carries the values of its parent context (loggers, trace spans) but
+// not its cancellation, the upstream request of coalesced requests outlives the caller
+// that started it.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (c detachedContext) Done() <-chan struct{}             { return nil }
+func (c detachedContext) Err() error                        { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
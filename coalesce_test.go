@@ -0,0 +1,207 @@
+package dhttp
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoalescingRoundTripper(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		w.Write([]byte("shared " + r.Header.Get("Authorization")))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewCoalescingRoundTripper(nil)}
+
+	get := func(authorization string) (string, error) {
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		request.Header.Set("Authorization", authorization)
+
+		response, err := client.Do(request)
+		if err != nil {
+			return "", err
+		}
+		defer response.Body.Close()
+
+		body, err := io.ReadAll(response.Body)
+		return string(body), err
+	}
+
+	var wg sync.WaitGroup
+	results := make([]string, 6)
+	for i := range results {
+		authorization := "a"
+		if i%2 == 1 {
+			authorization = "b"
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			body, err := get(authorization)
+			assert.NoError(t, err)
+			results[i] = body
+		}(i)
+	}
+
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 2 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.Equal(t, []string{"shared a", "shared b", "shared a", "shared b", "shared a", "shared b"}, results)
+}
+
+func TestCoalescingRoundTripper_NotCoalesced(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+	}{
+		{"range", http.Header{"Range": []string{"bytes=0-9"}}},
+		{"if-none-match", http.Header{"If-None-Match": []string{`"v1"`}}},
+		{"if-modified-since", http.Header{"If-Modified-Since": []string{"Wed, 01 Jan 2020 00:00:00 GMT"}}},
+		{"upgrade", http.Header{"Connection": []string{"Upgrade"}, "Upgrade": []string{"websocket"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int32
+			release := make(chan struct{})
+			transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+			})
+
+			coalescing := NewCoalescingRoundTripper(transport)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					request, _ := http.NewRequest("GET", "http://upstream/resource", nil)
+					request.Header = test.header.Clone()
+
+					response, err := coalescing.RoundTrip(request)
+					if assert.NoError(t, err) {
+						response.Body.Close()
+					}
+				}()
+			}
+
+			// Both requests reach upstream while the first one is still in flight
+			require.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 2 }, time.Second, time.Millisecond)
+			close(release)
+			wg.Wait()
+		})
+	}
+}
+
+func TestCoalescingRoundTripper_CancelledWaiters(t *testing.T) {
+	upstreamCancelled := make(chan struct{})
+	transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		<-r.Context().Done()
+		close(upstreamCancelled)
+		return nil, r.Context().Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	request, _ := http.NewRequestWithContext(ctx, "GET", "http://upstream/", nil)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := NewCoalescingRoundTripper(transport).RoundTrip(request)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	select {
+	case <-upstreamCancelled:
+	case <-time.After(time.Second):
+		t.Fatal("upstream request should have been cancelled")
+	}
+}
+
+func TestCoalescingRoundTripper_UnclaimedStreamedResponse(t *testing.T) {
+	var closed int32
+	release := make(chan struct{})
+	transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		<-release
+		body := &closeNotifyingBody{Reader: strings.NewReader("too big"), closed: &closed}
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, ContentLength: 7, Body: body}, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	request, _ := http.NewRequestWithContext(ctx, "GET", "http://upstream/", nil)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := NewCoalescingRoundTripper(transport, CoalesceMaxBodySize(1)).RoundTrip(request)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// The response arrives after every waiter left, nobody will ever close it
+	close(release)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&closed) == 1 }, time.Second, time.Millisecond)
+}
+
+func TestCoalescingRoundTripper_WaitersLeavingConcurrently(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		var created, closed int32
+		release := make(chan struct{})
+		transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			<-release
+			atomic.AddInt32(&created, 1)
+			body := &closeNotifyingBody{Reader: strings.NewReader("too big"), closed: &closed}
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, ContentLength: 7, Body: body}, nil
+		})
+
+		coalescing := NewCoalescingRoundTripper(transport, CoalesceMaxBodySize(1))
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				request, _ := http.NewRequestWithContext(ctx, "GET", "http://upstream/", nil)
+				if response, err := coalescing.RoundTrip(request); err == nil {
+					response.Body.Close()
+				}
+			}()
+		}
+
+		// The response arrives while the waiters are leaving
+		time.Sleep(time.Millisecond)
+		go close(release)
+		cancel()
+		wg.Wait()
+
+		// Every response, shared or performed by a waiter on its own, ends up closed
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt32(&created) > 0 && atomic.LoadInt32(&closed) == atomic.LoadInt32(&created)
+		}, time.Second, time.Millisecond)
+	}
+}
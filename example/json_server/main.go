@@ -23,8 +23,10 @@ func main() {
 	router.Path("/healthz").Handler(dhttp.JSONHandler(getHealth))
 
 	apiRouter := router.PathPrefix("/api/v1").Subrouter()
-	apiRouter.Use(middleware.NewCORSMiddleware(".*"))
+	apiRouter.Use(middleware.NewCORSMiddleware("*"))
 	apiRouter.Use(middleware.NewTracingLoggingMiddleware(zlog))
+	apiRouter.Use(middleware.NewRequestIDMiddleware(zlog))
+	apiRouter.Use(middleware.NewClientIPMiddleware(zlog, dhttp.NewDirectIPExtractor()))
 	apiRouter.Use(middleware.NewLogRequestMiddleware(zlog))
 
 	// Test with 'curl http://localhost:8080/api/v1/todos?user=john'
@@ -0,0 +1,178 @@
+package dhttp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/streamingfast/derr"
+)
+
+// hopByHopHeaders are the headers meaningful only for a single transport-level connection
+// that must not be forwarded by proxies.
+//
+// @see https://www.rfc-editor.org/rfc/rfc9110#section-7.6.1
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+const forwardBufferSize = 32 * 1024
+
+// RemoveHopByHopHeaders removes from `header` the hop-by-hop headers as well as any header
+// listed in its `Connection` header.
+func RemoveHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// CopyEndToEndHeaders adds all headers of `src` to `dst` except the hop-by-hop ones.
+func CopyEndToEndHeaders(dst, src http.Header) {
+	connectionHeaders := map[string]bool{}
+	for _, value := range src.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				connectionHeaders[textproto.CanonicalMIMEHeaderKey(name)] = true
+			}
+		}
+	}
+
+	for name, values := range src {
+		if connectionHeaders[name] || isHopByHopHeader(name) {
+			continue
+		}
+
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
+
+func isHopByHopHeader(name string) bool {
+	for _, hopByHop := range hopByHopHeaders {
+		if strings.EqualFold(name, hopByHop) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isUpgradeRequest returns true if the request asks to switch protocols (WebSocket, h2c),
+// its response being a connection rather than a body.
+func isUpgradeRequest(request *http.Request) bool {
+	if request.Header.Get("Upgrade") != "" {
+		return true
+	}
+
+	for _, value := range request.Header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if strings.EqualFold(textproto.TrimString(name), "upgrade") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// FowardResponse streams the upstream `response` to `w`, copying its status code, its
+// end-to-end headers and its trailers.
+//
+// The body is flushed after each write when the upstream response has no known length
+// (chunked) or is a server-sent events stream, so clients receive data as soon as
+// upstream produces it.
+//
+// If reading the upstream body fails before anything was written, a derr error is written
+// instead of the response. Once the headers have been sent, the error can only be logged
+// and forwarding stops, leaving the client with a truncated response.
+func FowardResponse(ctx context.Context, w http.ResponseWriter, response *http.Response) {
+	defer response.Body.Close()
+
+	buffer := make([]byte, forwardBufferSize)
+
+	// We read the first chunk prior sending the headers so that an upstream failing right
+	// away can still be reported properly.
+	n, readErr := response.Body.Read(buffer)
+	if readErr != nil && readErr != io.EOF && n == 0 {
+		WriteError(ctx, w, derr.Wrap(readErr, "unable to read response body while forwarding response"))
+		return
+	}
+
+	header := w.Header()
+	CopyEndToEndHeaders(header, response.Header)
+
+	if len(response.Trailer) > 0 {
+		trailerNames := make([]string, 0, len(response.Trailer))
+		for name := range response.Trailer {
+			trailerNames = append(trailerNames, name)
+		}
+
+		header.Set("Trailer", strings.Join(trailerNames, ", "))
+	}
+
+	flusher, _ := w.(http.Flusher)
+	flush := flusher != nil && shouldFlushResponse(response)
+
+	w.WriteHeader(response.StatusCode)
+
+	for {
+		if n > 0 {
+			if _, err := w.Write(buffer[:n]); err != nil {
+				logWriteResponseError(ctx, "failed forwarding response", err)
+				return
+			}
+
+			if flush {
+				flusher.Flush()
+			}
+		}
+
+		if readErr != nil {
+			break
+		}
+
+		n, readErr = response.Body.Read(buffer)
+	}
+
+	if readErr != io.EOF {
+		if !errors.Is(readErr, context.Canceled) {
+			logWriteResponseError(ctx, "failed reading upstream response body while forwarding response", readErr)
+		}
+		return
+	}
+
+	// Trailers are only known once the body has been fully read
+	for name, values := range response.Trailer {
+		for _, value := range values {
+			header.Add(name, value)
+		}
+	}
+}
+
+func shouldFlushResponse(response *http.Response) bool {
+	if response.ContentLength == -1 && response.Header.Get("Content-Length") == "" {
+		return true
+	}
+
+	return strings.HasPrefix(strings.ToLower(response.Header.Get("Content-Type")), "text/event-stream")
+}
@@ -0,0 +1,84 @@
+package dhttp
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFowardResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "X-Internal")
+		w.Header().Set("X-Internal", "secret")
+		w.Header().Set("Trailer", "X-Checksum")
+		w.WriteHeader(http.StatusAccepted)
+
+		w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("data: 2\n\n"))
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer upstream.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response, err := http.Get(upstream.URL)
+		require.NoError(t, err)
+
+		FowardResponse(r.Context(), w, response)
+	}))
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusAccepted, response.StatusCode)
+	assert.Equal(t, "data: 1\n\ndata: 2\n\n", string(body))
+	assert.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+	assert.Equal(t, "no-cache", response.Header.Get("Cache-Control"))
+	assert.Empty(t, response.Header.Get("X-Internal"))
+	assert.Equal(t, "abc", response.Trailer.Get("X-Checksum"))
+}
+
+func TestFowardResponse_ReadError(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/", nil)
+	response := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/plain"}},
+		Body:       io.NopCloser(failingReader{errors.New("connection reset")}),
+	}
+
+	FowardResponse(request.Context(), recorder, response)
+
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.NotEqual(t, "text/plain", recorder.Header().Get("Content-Type"))
+}
+
+func TestRemoveHopByHopHeaders(t *testing.T) {
+	header := http.Header{
+		"Connection":        []string{"close, X-Custom"},
+		"X-Custom":          []string{"value"},
+		"Keep-Alive":        []string{"timeout=5"},
+		"Transfer-Encoding": []string{"chunked"},
+		"Content-Type":      []string{"application/json"},
+	}
+
+	RemoveHopByHopHeaders(header)
+
+	assert.Equal(t, http.Header{"Content-Type": []string{"application/json"}}, header)
+}
+
+type failingReader struct{ err error }
+
+func (r failingReader) Read(p []byte) (int, error) { return 0, r.err }
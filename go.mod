@@ -4,10 +4,11 @@ go 1.19
 
 require (
 	github.com/GoogleCloudPlatform/opentelemetry-operations-go/propagator v0.39.0
-	github.com/gorilla/handlers v0.0.0-20181012153334-350d97a79266
+	github.com/andybalholm/brotli v1.0.5
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/schema v1.0.2
 	github.com/iancoleman/strcase v0.2.0
+	github.com/klauspost/compress v1.15.11
 	github.com/streamingfast/derr v0.0.0-20220301163149-de09cb18fc70
 	github.com/streamingfast/dtracing v0.0.0-20220305214756-b5c0e8699839
 	github.com/streamingfast/logging v0.0.0-20220304214715-bc750a74b424
@@ -17,6 +18,7 @@ require (
 	go.opencensus.io v0.24.0
 	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.42.0
 	go.opentelemetry.io/otel v1.16.0
+	go.opentelemetry.io/otel/trace v1.16.0
 	go.uber.org/zap v1.21.0
 )
 
@@ -67,7 +69,6 @@ require (
 	go.opentelemetry.io/otel/exporters/zipkin v1.15.1 // indirect
 	go.opentelemetry.io/otel/metric v1.16.0 // indirect
 	go.opentelemetry.io/otel/sdk v1.15.1 // indirect
-	go.opentelemetry.io/otel/trace v1.16.0 // indirect
 	go.opentelemetry.io/proto/otlp v0.19.0 // indirect
 	go.uber.org/atomic v1.7.0 // indirect
 	go.uber.org/multierr v1.8.0 // indirect
@@ -0,0 +1,511 @@
+package dhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streamingfast/logging"
+	"go.uber.org/zap"
+)
+
+const harHeader = `{"log":{"version":"1.2","creator":{"name":"dhttp","version":"1.0"},"entries":[`
+const harFooter = "\n]}}\n"
+
+// HARWriter writes HTTP Archive (HAR 1.2) entries to an `io.Writer` or to a file rotated
+// by size. The archive is streamed, it's a valid HAR document only once `Close` has been
+// called (or, for a rotating file writer, once the file has been rotated).
+type HARWriter struct {
+	lock    sync.Mutex
+	writer  io.Writer
+	file    *os.File
+	path    string
+	maxSize int64
+	written int64
+	entries int
+	started bool
+}
+
+// NewHARWriter creates a `HARWriter` writing the archive to `writer`, `Close` must be
+// called to terminate the archive, it does not close `writer`.
+func NewHARWriter(writer io.Writer) *HARWriter {
+	return &HARWriter{writer: writer}
+}
+
+// NewHARFileWriter creates a `HARWriter` writing the archive to the file at `path`,
+// truncating it if it exists. When `maxSize` is greater than 0, the file is rotated once
+// it reaches `maxSize` bytes, the current file is terminated and renamed with a timestamp
+// suffix (`traffic.har` becomes `traffic-20060102T150405.000000000.har`) and a new archive
+// is started at `path`.
+func NewHARFileWriter(path string, maxSize int64) (*HARWriter, error) {
+	w := &HARWriter{path: path, maxSize: maxSize}
+	if err := w.openFile(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *HARWriter) writeEntry(entry *harEntry) error {
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("unable to encode HAR entry: %w", err)
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.writer == nil {
+		return fmt.Errorf("HAR writer is closed")
+	}
+
+	if w.file != nil && w.maxSize > 0 && w.entries > 0 && w.written+int64(len(content)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if err := w.start(); err != nil {
+		return err
+	}
+
+	separator := "\n"
+	if w.entries > 0 {
+		separator = ",\n"
+	}
+
+	if err := w.write(separator, string(content)); err != nil {
+		return err
+	}
+
+	w.entries++
+	return nil
+}
+
+// Close terminates the archive and closes the file for writers created through
+// `NewHARFileWriter`.
+func (w *HARWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.writer == nil {
+		return nil
+	}
+
+	err := w.terminate()
+	w.writer = nil
+
+	return err
+}
+
+func (w *HARWriter) write(parts ...string) error {
+	for _, part := range parts {
+		n, err := io.WriteString(w.writer, part)
+		w.written += int64(n)
+		if err != nil {
+			return fmt.Errorf("unable to write HAR: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// start writes the archive header if it has not been written yet.
+func (w *HARWriter) start() error {
+	if w.started {
+		return nil
+	}
+
+	w.started = true
+	return w.write(harHeader)
+}
+
+func (w *HARWriter) terminate() error {
+	if err := w.start(); err != nil {
+		return err
+	}
+
+	if err := w.write(harFooter); err != nil {
+		return err
+	}
+
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			return fmt.Errorf("unable to close HAR file %q: %w", w.path, err)
+		}
+	}
+
+	return nil
+}
+
+func (w *HARWriter) rotate() error {
+	if err := w.terminate(); err != nil {
+		return err
+	}
+
+	extension := filepath.Ext(w.path)
+	rotatedPath := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(w.path, extension), time.Now().UTC().Format("20060102T150405.000000000"), extension)
+	if err := os.Rename(w.path, rotatedPath); err != nil {
+		return fmt.Errorf("unable to rotate HAR file %q: %w", w.path, err)
+	}
+
+	return w.openFile()
+}
+
+func (w *HARWriter) openFile() error {
+	file, err := os.Create(w.path)
+	if err != nil {
+		return fmt.Errorf("unable to create HAR file %q: %w", w.path, err)
+	}
+
+	w.file = file
+	w.writer = file
+	w.written = 0
+	w.entries = 0
+	w.started = false
+
+	return w.start()
+}
+
+type HAROption func(t *HARRoundTripper)
+
+// HARMaxBodySize sets the maximum amount of bytes of request and response bodies kept
+// in the archive, bodies are truncated past it. Defaults to 1 MiB.
+func HARMaxBodySize(maxBodySize int) HAROption {
+	return func(t *HARRoundTripper) {
+		t.maxBodySize = maxBodySize
+	}
+}
+
+// HARRedactHeaders adds headers to redact from archived entries on top of
+// `DefaultRedactedHeaders`.
+func HARRedactHeaders(headers ...string) HAROption {
+	return func(t *HARRoundTripper) {
+		t.redactedHeaders = append(t.redactedHeaders, headers...)
+	}
+}
+
+// HARLogger sets the logger used to log failures to write entries, the request specific
+// logger is used if one exists in the request's context.
+func HARLogger(logger *zap.Logger) HAROption {
+	return func(t *HARRoundTripper) {
+		t.logger = logger
+	}
+}
+
+// NewHARRoundTripper creates a wrapping `http.RoundTripper` that archives each request
+// and its response as an HTTP Archive (HAR 1.2) entry in `writer`, including the timing
+// breakdown of the request. The entry is written once the response body has been fully
+// read or closed, or right away for `101 Switching Protocols` responses whose upgraded
+// connection is not archived. Headers in `DefaultRedactedHeaders` (and those added with
+// `HARRedactHeaders`) are redacted.
+//
+// The resulting file can be opened in browser devtools or any HAR viewer.
+//
+// If the received `next` argument is set as `nil`, the `http.DefaultTransport` value
+// will be used as the actual transport handler.
+func NewHARRoundTripper(writer *HARWriter, next http.RoundTripper, opts ...HAROption) *HARRoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	t := &HARRoundTripper{
+		writer:          writer,
+		transport:       next,
+		logger:          zlog,
+		maxBodySize:     1024 * 1024,
+		redactedHeaders: append([]string(nil), DefaultRedactedHeaders...),
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	return t
+}
+
+type HARRoundTripper struct {
+	writer          *HARWriter
+	transport       http.RoundTripper
+	logger          *zap.Logger
+	maxBodySize     int
+	redactedHeaders []string
+}
+
+func (t *HARRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	requestBody, request, err := readRequestBody(request)
+	if err != nil {
+		return nil, err
+	}
+
+	timings := newClientTimings()
+	request = request.WithContext(httptrace.WithClientTrace(request.Context(), timings.clientTrace()))
+
+	entry := &harEntry{
+		StartedDateTime: timings.start.Format(time.RFC3339Nano),
+		Request:         t.harRequest(request, requestBody),
+		Cache:           struct{}{},
+	}
+
+	response, err := t.transport.RoundTrip(request)
+	if err != nil {
+		entry.Response = harResponse{Cookies: []harNameValue{}, Headers: []harNameValue{}, HeadersSize: -1, BodySize: -1}
+		entry.Error = err.Error()
+		t.write(request, entry, timings, time.Now())
+
+		return nil, err
+	}
+
+	entry.Response = harResponse{
+		Status:      response.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(response.Status, fmt.Sprintf("%d", response.StatusCode))),
+		HTTPVersion: response.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(redactHeaders(response.Header, t.redactedHeaders)),
+		RedirectURL: response.Header.Get("Location"),
+		HeadersSize: -1,
+	}
+
+	if response.StatusCode == http.StatusSwitchingProtocols {
+		// The body is the upgraded connection (an `io.ReadWriteCloser`), its traffic is not archived
+		entry.Response.Content = harContent(nil, 0, response.Header.Get("Content-Type"))
+		t.write(request, entry, timings, time.Now())
+
+		return response, nil
+	}
+
+	response.Body = &harBody{
+		ReadCloser: response.Body,
+		maxSize:    t.maxBodySize,
+		done: func(body []byte, size int64) {
+			entry.Response.BodySize = size
+			entry.Response.Content = harContent(body, size, response.Header.Get("Content-Type"))
+			t.write(request, entry, timings, time.Now())
+		},
+	}
+
+	return response, nil
+}
+
+func (t *HARRoundTripper) harRequest(request *http.Request, body []byte) harRequest {
+	out := harRequest{
+		Method:      request.Method,
+		URL:         request.URL.String(),
+		HTTPVersion: request.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(redactHeaders(request.Header, t.redactedHeaders)),
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    int64(len(body)),
+	}
+
+	if out.HTTPVersion == "" {
+		out.HTTPVersion = "HTTP/1.1"
+	}
+
+	for name, values := range request.URL.Query() {
+		for _, value := range values {
+			out.QueryString = append(out.QueryString, harNameValue{Name: name, Value: value})
+		}
+	}
+
+	if len(body) > 0 {
+		text := body
+		if len(text) > t.maxBodySize {
+			text = text[:t.maxBodySize]
+		}
+
+		out.PostData = &harPostData{MimeType: request.Header.Get("Content-Type"), Text: string(text)}
+	}
+
+	return out
+}
+
+func (t *HARRoundTripper) write(request *http.Request, entry *harEntry, timings *clientTimings, end time.Time) {
+	entry.Timings = timings.harTimings(end)
+	entry.Time = float64(end.Sub(timings.start)) / float64(time.Millisecond)
+
+	if err := t.writer.writeEntry(entry); err != nil {
+		logging.Logger(request.Context(), t.logger).Warn("unable to write HAR entry", zap.String("url", request.URL.String()), zap.Error(err))
+	}
+}
+
+// harTimings computes the HAR timings, in milliseconds, of a request that completed at `end`,
+// phases that did not happen (e.g. DNS and connect on a re-used connection) are -1.
+func (c *clientTimings) harTimings(end time.Time) harTimings {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ms := func(start, end time.Time) float64 {
+		if start.IsZero() || end.IsZero() {
+			return -1
+		}
+
+		return float64(end.Sub(start)) / float64(time.Millisecond)
+	}
+
+	connectDone := c.connectDone
+	if c.tlsDone.After(connectDone) {
+		connectDone = c.tlsDone
+	}
+
+	timings := harTimings{
+		Blocked: -1,
+		DNS:     ms(c.dnsStart, c.dnsDone),
+		Connect: ms(c.connectStart, connectDone),
+		SSL:     ms(c.tlsStart, c.tlsDone),
+		Send:    ms(c.gotConn, c.wroteRequest),
+		Wait:    ms(c.wroteRequest, c.firstByte),
+		Receive: ms(c.firstByte, end),
+	}
+
+	if blocked := ms(c.start, c.gotConn); blocked >= 0 {
+		blocked -= maxFloat(timings.DNS, 0) + maxFloat(timings.Connect, 0)
+		timings.Blocked = maxFloat(blocked, 0)
+	}
+
+	// HAR requires send, wait and receive to be non-negative
+	timings.Send = maxFloat(timings.Send, 0)
+	timings.Wait = maxFloat(timings.Wait, 0)
+	timings.Receive = maxFloat(timings.Receive, 0)
+
+	return timings
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	out := []harNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			out = append(out, harNameValue{Name: name, Value: value})
+		}
+	}
+
+	return out
+}
+
+func harContent(body []byte, size int64, contentType string) harResponseContent {
+	content := harResponseContent{Size: size, MimeType: contentType}
+	if content.MimeType == "" {
+		content.MimeType = "application/octet-stream"
+	}
+
+	content.Text, content.Encoding = encodeBody(body)
+
+	return content
+}
+
+// harBody captures up to `maxSize` bytes of the body while it's being read and invokes
+// `done` once the body has been fully read or closed.
+type harBody struct {
+	io.ReadCloser
+	maxSize  int
+	captured bytes.Buffer
+	size     int64
+	once     sync.Once
+	done     func(body []byte, size int64)
+}
+
+func (b *harBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+	if remaining := b.maxSize - b.captured.Len(); remaining > 0 {
+		if remaining > n {
+			remaining = n
+		}
+
+		b.captured.Write(p[:remaining])
+	}
+
+	if err != nil {
+		b.finish()
+	}
+
+	return n, err
+}
+
+func (b *harBody) Close() error {
+	defer b.finish()
+
+	return b.ReadCloser.Close()
+}
+
+func (b *harBody) finish() {
+	b.once.Do(func() { b.done(b.captured.Bytes(), b.size) })
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Error           string      `json:"_error,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harResponse struct {
+	Status      int                `json:"status"`
+	StatusText  string             `json:"statusText"`
+	HTTPVersion string             `json:"httpVersion"`
+	Cookies     []harNameValue     `json:"cookies"`
+	Headers     []harNameValue     `json:"headers"`
+	Content     harResponseContent `json:"content"`
+	RedirectURL string             `json:"redirectURL"`
+	HeadersSize int64              `json:"headersSize"`
+	BodySize    int64              `json:"bodySize"`
+}
+
+type harResponseContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
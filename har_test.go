@@ -0,0 +1,84 @@
+package dhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type harTestDocument struct {
+	Log struct {
+		Version string     `json:"version"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+func TestHARRoundTripper(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	buffer := bytes.NewBuffer(nil)
+	writer := NewHARWriter(buffer)
+	client := &http.Client{Transport: NewHARRoundTripper(writer, nil)}
+
+	for i := 0; i < 2; i++ {
+		request, _ := http.NewRequest("GET", server.URL+"/path?a=b", nil)
+		request.Header.Set("Authorization", "Bearer secret")
+
+		response, err := client.Do(request)
+		require.NoError(t, err)
+		io.ReadAll(response.Body)
+		response.Body.Close()
+	}
+
+	require.NoError(t, writer.Close())
+
+	document := harTestDocument{}
+	require.NoError(t, json.Unmarshal(buffer.Bytes(), &document), buffer.String())
+	assert.Equal(t, "1.2", document.Log.Version)
+	require.Len(t, document.Log.Entries, 2)
+
+	entry := document.Log.Entries[0]
+	assert.Equal(t, "GET", entry.Request.Method)
+	assert.Contains(t, entry.Request.Headers, harNameValue{Name: "Authorization", Value: redactedHeaderValue})
+	assert.Equal(t, []harNameValue{{Name: "a", Value: "b"}}, entry.Request.QueryString)
+	assert.Equal(t, 200, entry.Response.Status)
+	assert.Equal(t, "hello", entry.Response.Content.Text)
+	assert.Equal(t, int64(5), entry.Response.BodySize)
+	assert.GreaterOrEqual(t, entry.Timings.Wait, 0.0)
+}
+
+func TestHARFileWriter_Rotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.har")
+	writer, err := NewHARFileWriter(path, 200)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, writer.writeEntry(&harEntry{Request: harRequest{Method: "GET", URL: "http://localhost/"}}))
+	}
+	require.NoError(t, writer.Close())
+
+	files, err := filepath.Glob(filepath.Join(filepath.Dir(path), "*.har"))
+	require.NoError(t, err)
+	assert.Len(t, files, 3)
+
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		require.NoError(t, err)
+
+		document := harTestDocument{}
+		require.NoError(t, json.Unmarshal(content, &document), string(content))
+		assert.Len(t, document.Log.Entries, 1)
+	}
+}
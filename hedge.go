@@ -0,0 +1,379 @@
+package dhttp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/streamingfast/logging"
+	"go.uber.org/zap"
+)
+
+// maxHedgeLatencySamples is the number of most recent latencies kept to compute the
+// hedging delay when using `HedgeLatencyPercentile`.
+const maxHedgeLatencySamples = 1000
+
+// hedgeDelayRefreshSamples is the number of latencies recorded between two computations of
+// the percentile hedging delay, sorting the samples on every request would be wasteful.
+const hedgeDelayRefreshSamples = 50
+
+type HedgeOption func(t *HedgingRoundTripper)
+
+// HedgeEndpoints sets the alternate base URLs (scheme and host, e.g. `http://replica-2:8080`)
+// hedged requests are sent to, in order, cycling if there are more attempts than endpoints.
+// The first attempt always goes to the request's original URL. Without endpoints, hedged
+// requests are sent to the original URL.
+func HedgeEndpoints(endpoints ...string) HedgeOption {
+	return func(t *HedgingRoundTripper) {
+		for _, endpoint := range endpoints {
+			parsed, err := url.Parse(endpoint)
+			if err != nil {
+				panic(fmt.Errorf("invalid hedge endpoint %q: %w", endpoint, err))
+			}
+
+			t.endpoints = append(t.endpoints, parsed)
+		}
+	}
+}
+
+// HedgeMaxAttempts sets the maximum number of copies of a request sent, including the
+// first one, defaults to 2.
+func HedgeMaxAttempts(attempts int) HedgeOption {
+	return func(t *HedgingRoundTripper) {
+		t.maxAttempts = attempts
+	}
+}
+
+// HedgeDelay sets the fixed delay after which a new copy of the request is sent if no
+// response was received yet, defaults to 100ms. When `HedgeLatencyPercentile` is used,
+// it's the delay used until enough latencies have been observed.
+func HedgeDelay(delay time.Duration) HedgeOption {
+	return func(t *HedgingRoundTripper) {
+		t.delay = delay
+	}
+}
+
+// HedgeLatencyPercentile makes the hedging delay the given percentile (between 0 and 100,
+// e.g. 95) of the latencies of the last successful requests, once at least `minSamples`
+// were observed.
+func HedgeLatencyPercentile(percentile float64, minSamples int) HedgeOption {
+	return func(t *HedgingRoundTripper) {
+		t.percentile = percentile
+		t.minSamples = minSamples
+	}
+}
+
+// HedgeLogger sets the logger used to log hedged requests outcome, the request specific
+// logger is used if one exists in the request's context.
+func HedgeLogger(logger *zap.Logger) HedgeOption {
+	return func(t *HedgingRoundTripper) {
+		t.logger = logger
+	}
+}
+
+// NewHedgingRoundTripper creates a wrapping `http.RoundTripper` reducing tail latency of
+// idempotent requests to replicated backends. When no response was received after the
+// hedging delay (see `HedgeDelay` and `HedgeLatencyPercentile`), a copy of the request is
+// sent to the next alternate endpoint (see `HedgeEndpoints`), up to `HedgeMaxAttempts`
+// copies. The first successful (non-5xx) response is returned, the other attempts are
+// cancelled and their bodies closed. A failed attempt triggers the next one right away.
+//
+// Non-idempotent requests (see `NewRetryingRoundTripper`), connection upgrades and requests
+// with a body that cannot be rewound are sent once, as-is.
+//
+// If the received `next` argument is set as `nil`, the `http.DefaultTransport` value
+// will be used as the actual transport handler.
+func NewHedgingRoundTripper(next http.RoundTripper, opts ...HedgeOption) *HedgingRoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	t := &HedgingRoundTripper{
+		transport:   next,
+		logger:      zlog,
+		maxAttempts: 2,
+		delay:       100 * time.Millisecond,
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	return t
+}
+
+type HedgingRoundTripper struct {
+	transport   http.RoundTripper
+	logger      *zap.Logger
+	endpoints   []*url.URL
+	maxAttempts int
+	delay       time.Duration
+	percentile  float64
+	minSamples  int
+
+	lock            sync.Mutex
+	latencies       []time.Duration
+	next            int
+	sinceRefresh    int
+	percentileDelay time.Duration
+}
+
+type hedgeResult struct {
+	attempt  int
+	response *http.Response
+	err      error
+	cancel   context.CancelFunc
+}
+
+func (t *HedgingRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	if t.maxAttempts <= 1 || !isIdempotent(request) || isUpgradeRequest(request) || (request.Body != nil && request.Body != http.NoBody && request.GetBody == nil) {
+		return t.transport.RoundTrip(request)
+	}
+
+	ctx := request.Context()
+	results := make(chan *hedgeResult, t.maxAttempts)
+	launched, pending := 0, 0
+	cancels := make([]context.CancelFunc, 0, t.maxAttempts)
+
+	launch := func() {
+		attempt := launched
+		launched++
+		pending++
+
+		attemptCtx, cancel := context.WithCancel(ctx)
+		cancels = append(cancels, cancel)
+		go func() {
+			start := time.Now()
+			response, err := t.roundTripAttempt(attemptCtx, request, attempt)
+			if err == nil && response.StatusCode < 500 {
+				t.recordLatency(time.Since(start))
+			}
+
+			results <- &hedgeResult{attempt: attempt, response: response, err: err, cancel: cancel}
+		}()
+	}
+
+	launch()
+
+	timer := time.NewTimer(t.hedgeDelay())
+	defer timer.Stop()
+
+	var last *hedgeResult
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if launched < t.maxAttempts {
+				launch()
+				resetTimer(timer, t.hedgeDelay())
+			}
+
+		case result := <-results:
+			pending--
+
+			if result.err == nil && result.response.StatusCode < 500 {
+				for attempt, cancel := range cancels {
+					if attempt != result.attempt {
+						cancel()
+					}
+				}
+
+				if last != nil {
+					closeHedgeResult(last)
+				}
+
+				t.discard(results, pending)
+				t.logWinner(ctx, request, result, launched)
+
+				result.response.Body = newCancelOnCloseBody(result.response.Body, result.cancel)
+				return result.response, nil
+			}
+
+			if last != nil {
+				closeHedgeResult(last)
+			}
+			last = result
+
+			if launched < t.maxAttempts && ctx.Err() == nil {
+				launch()
+				resetTimer(timer, t.hedgeDelay())
+			}
+		}
+	}
+
+	if last.err != nil {
+		last.cancel()
+		return nil, last.err
+	}
+
+	last.response.Body = newCancelOnCloseBody(last.response.Body, last.cancel)
+	return last.response, nil
+}
+
+func (t *HedgingRoundTripper) roundTripAttempt(ctx context.Context, request *http.Request, attempt int) (*http.Response, error) {
+	// The first attempt sends the original body so that the transport closes it, the
+	// others send a copy
+	attemptRequest := request.Clone(ctx)
+	if attempt > 0 && request.Body != nil && request.Body != http.NoBody {
+		body, err := request.GetBody()
+		if err != nil {
+			return nil, fmt.Errorf("unable to rewind request body: %w", err)
+		}
+
+		attemptRequest.Body = body
+	}
+
+	if attempt > 0 && len(t.endpoints) > 0 {
+		endpoint := t.endpoints[(attempt-1)%len(t.endpoints)]
+		attemptRequest.URL.Scheme = endpoint.Scheme
+		attemptRequest.URL.Host = endpoint.Host
+		attemptRequest.Host = ""
+	}
+
+	return t.transport.RoundTrip(attemptRequest)
+}
+
+// discard closes the response of the remaining in-flight attempts once they complete,
+// without blocking the caller.
+func (t *HedgingRoundTripper) discard(results chan *hedgeResult, pending int) {
+	if pending == 0 {
+		return
+	}
+
+	go func() {
+		for i := 0; i < pending; i++ {
+			closeHedgeResult(<-results)
+		}
+	}()
+}
+
+func (t *HedgingRoundTripper) logWinner(ctx context.Context, request *http.Request, winner *hedgeResult, launched int) {
+	if launched <= 1 {
+		return
+	}
+
+	host := request.URL.Host
+	if winner.attempt > 0 && len(t.endpoints) > 0 {
+		host = t.endpoints[(winner.attempt-1)%len(t.endpoints)].Host
+	}
+
+	logging.Logger(ctx, t.logger).Debug(fmt.Sprintf("hedged HTTP request %s %s won by attempt #%d", request.Method, request.URL.String(), winner.attempt+1),
+		zap.Int("attempt", winner.attempt+1),
+		zap.Int("attempts", launched),
+		zap.String("host", host),
+	)
+}
+
+func (t *HedgingRoundTripper) hedgeDelay() time.Duration {
+	if t.percentile <= 0 {
+		return t.delay
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.percentileDelay <= 0 {
+		return t.delay
+	}
+
+	return t.percentileDelay
+}
+
+// recordLatency adds a latency sample, the percentile hedging delay is re-computed once
+// `minSamples` are available and then every `hedgeDelayRefreshSamples` samples.
+func (t *HedgingRoundTripper) recordLatency(latency time.Duration) {
+	if t.percentile <= 0 {
+		return
+	}
+
+	t.lock.Lock()
+	if len(t.latencies) < maxHedgeLatencySamples {
+		t.latencies = append(t.latencies, latency)
+	} else {
+		t.latencies[t.next] = latency
+		t.next = (t.next + 1) % maxHedgeLatencySamples
+	}
+
+	t.sinceRefresh++
+	if len(t.latencies) < t.minSamples || (t.percentileDelay > 0 && t.sinceRefresh < hedgeDelayRefreshSamples) {
+		t.lock.Unlock()
+		return
+	}
+
+	t.sinceRefresh = 0
+	sorted := append([]time.Duration(nil), t.latencies...)
+	t.lock.Unlock()
+
+	// Sorting happens outside of the lock so that concurrent requests are not held up
+	delay := latencyPercentile(sorted, t.percentile)
+
+	t.lock.Lock()
+	t.percentileDelay = delay
+	t.lock.Unlock()
+}
+
+func latencyPercentile(latencies []time.Duration, percentile float64) time.Duration {
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	index := int(math.Ceil(percentile/100*float64(len(latencies)))) - 1
+	if index < 0 {
+		index = 0
+	} else if index >= len(latencies) {
+		index = len(latencies) - 1
+	}
+
+	return latencies[index]
+}
+
+// resetTimer resets a timer whose channel may not have been drained yet.
+func resetTimer(timer *time.Timer, delay time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+
+	timer.Reset(delay)
+}
+
+func closeHedgeResult(result *hedgeResult) {
+	result.cancel()
+	if result.response != nil {
+		result.response.Body.Close()
+	}
+}
+
+// newCancelOnCloseBody wraps `body` so that `cancel` is invoked once it's closed, the
+// body of a `101 Switching Protocols` response staying writable.
+func newCancelOnCloseBody(body io.ReadCloser, cancel context.CancelFunc) io.ReadCloser {
+	cancelling := &cancelOnCloseBody{ReadCloser: body, cancel: cancel}
+	if writer, ok := body.(io.Writer); ok {
+		return &cancelOnCloseReadWriteBody{cancelOnCloseBody: cancelling, Writer: writer}
+	}
+
+	return cancelling
+}
+
+// cancelOnCloseBody cancels the context of the request that produced the body once
+// the body is closed.
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	defer b.cancel()
+
+	return b.ReadCloser.Close()
+}
+
+type cancelOnCloseReadWriteBody struct {
+	*cancelOnCloseBody
+	io.Writer
+}
@@ -0,0 +1,161 @@
+package dhttp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHedgingRoundTripper(t *testing.T) {
+	slowCancelled := make(chan struct{}, 1)
+	var slowCalls int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&slowCalls, 1)
+		select {
+		case <-r.Context().Done():
+			slowCancelled <- struct{}{}
+		case <-time.After(2 * time.Second):
+			w.Write([]byte("slow"))
+		}
+	}))
+	defer slow.Close()
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	client := &http.Client{Transport: NewHedgingRoundTripper(nil, HedgeEndpoints(fast.URL), HedgeDelay(20*time.Millisecond))}
+
+	t.Run("hedged request wins", func(t *testing.T) {
+		response, err := client.Get(slow.URL + "/resource")
+		require.NoError(t, err)
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+
+		assert.Equal(t, "fast", string(body))
+
+		select {
+		case <-slowCancelled:
+		case <-time.After(time.Second):
+			t.Fatal("slow attempt should have been cancelled")
+		}
+	})
+
+	t.Run("non idempotent request is not hedged", func(t *testing.T) {
+		atomic.StoreInt32(&slowCalls, 0)
+		request, _ := http.NewRequest("POST", fast.URL, strings.NewReader("body"))
+
+		response, err := client.Do(request)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+
+		assert.Equal(t, "fast", string(body))
+	})
+}
+
+func TestHedgingRoundTripper_hedgeDelay(t *testing.T) {
+	hedger := NewHedgingRoundTripper(nil, HedgeDelay(time.Second), HedgeLatencyPercentile(90, 10))
+	assert.Equal(t, time.Second, hedger.hedgeDelay())
+
+	for i := 1; i <= 10; i++ {
+		hedger.recordLatency(time.Duration(i) * time.Millisecond)
+	}
+
+	assert.Equal(t, 9*time.Millisecond, hedger.hedgeDelay())
+}
+
+func TestHedgingRoundTripper_ClosesLosingAttempts(t *testing.T) {
+	var failedClosed int32
+	var attempts int32
+	transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			body := &closeNotifyingBody{Reader: strings.NewReader("failed"), closed: &failedClosed}
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}, Body: body}, nil
+		}
+
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("ok"))}, nil
+	})
+
+	request, err := http.NewRequest("GET", "http://example.com", nil)
+	require.NoError(t, err)
+
+	response, err := NewHedgingRoundTripper(transport, HedgeDelay(time.Second)).RoundTrip(request)
+	require.NoError(t, err)
+	response.Body.Close()
+
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&failedClosed))
+}
+
+type closeNotifyingBody struct {
+	io.Reader
+	closed *int32
+}
+
+func (b *closeNotifyingBody) Close() error {
+	atomic.AddInt32(b.closed, 1)
+	return nil
+}
+
+func TestHedgingRoundTripper_Upgrade(t *testing.T) {
+	var attempts int32
+	transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&attempts, 1)
+		time.Sleep(20 * time.Millisecond)
+		return &http.Response{StatusCode: http.StatusSwitchingProtocols, Header: http.Header{}, Body: &readWriteCloser{}}, nil
+	})
+
+	request, _ := http.NewRequest("GET", "http://upstream/ws", nil)
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+
+	response, err := NewHedgingRoundTripper(transport, HedgeDelay(time.Millisecond)).RoundTrip(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+	_, writable := response.Body.(io.ReadWriteCloser)
+	assert.True(t, writable, "upgraded body must remain writable")
+}
+
+func Test_newCancelOnCloseBody(t *testing.T) {
+	cancelled := false
+	body := newCancelOnCloseBody(&readWriteCloser{}, func() { cancelled = true })
+
+	_, writable := body.(io.ReadWriteCloser)
+	assert.True(t, writable)
+
+	body.Close()
+	assert.True(t, cancelled)
+}
+
+func TestHedgingRoundTripper_ClosesRequestBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	request, err := http.NewRequest("PUT", server.URL, strings.NewReader("payload"))
+	require.NoError(t, err)
+
+	var closed int32
+	request.Body = &closeNotifyingBody{Reader: strings.NewReader("payload"), closed: &closed}
+
+	response, err := NewHedgingRoundTripper(nil).RoundTrip(request)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+
+	assert.Equal(t, "payload", string(body))
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&closed) == 1 }, time.Second, time.Millisecond)
+}
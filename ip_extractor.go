@@ -0,0 +1,330 @@
+package dhttp
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Headers from which an `IPExtractor` can read the client address.
+const (
+	HeaderXForwardedFor  = "X-Forwarded-For"
+	HeaderForwarded      = "Forwarded"
+	HeaderXRealIP        = "X-Real-IP"
+	HeaderCFConnectingIP = "CF-Connecting-IP"
+	HeaderTrueClientIP   = "True-Client-IP"
+)
+
+// DefaultIPExtractor is the `IPExtractor` used by `RealIP`, it assumes the service runs
+// behind a Google Cloud Load Balancer. Replace it at startup when deployed differently.
+var DefaultIPExtractor = NewGCLBIPExtractor()
+
+// PrivateNetworks are the loopback, private and link-local ranges, typically those of
+// proxies running in the same network as the service.
+var PrivateNetworks = []netip.Prefix{
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+}
+
+// CloudflareNetworks are the ranges Cloudflare connects from.
+//
+// @see https://www.cloudflare.com/ips/
+var CloudflareNetworks = []netip.Prefix{
+	netip.MustParsePrefix("173.245.48.0/20"),
+	netip.MustParsePrefix("103.21.244.0/22"),
+	netip.MustParsePrefix("103.22.200.0/22"),
+	netip.MustParsePrefix("103.31.4.0/22"),
+	netip.MustParsePrefix("141.101.64.0/18"),
+	netip.MustParsePrefix("108.162.192.0/18"),
+	netip.MustParsePrefix("190.93.240.0/20"),
+	netip.MustParsePrefix("188.114.96.0/20"),
+	netip.MustParsePrefix("197.234.240.0/22"),
+	netip.MustParsePrefix("198.41.128.0/17"),
+	netip.MustParsePrefix("162.158.0.0/15"),
+	netip.MustParsePrefix("104.16.0.0/13"),
+	netip.MustParsePrefix("104.24.0.0/14"),
+	netip.MustParsePrefix("172.64.0.0/13"),
+	netip.MustParsePrefix("131.0.72.0/22"),
+	netip.MustParsePrefix("2400:cb00::/32"),
+	netip.MustParsePrefix("2606:4700::/32"),
+	netip.MustParsePrefix("2803:f800::/32"),
+	netip.MustParsePrefix("2405:b500::/32"),
+	netip.MustParsePrefix("2405:8100::/32"),
+	netip.MustParsePrefix("2a06:98c0::/29"),
+	netip.MustParsePrefix("2c0f:f248::/32"),
+}
+
+type IPExtractorOption func(e *IPExtractor)
+
+// IPExtractorHeader sets the header the client address is read from, one of
+// `HeaderXForwardedFor`, `HeaderForwarded`, `HeaderXRealIP`, `HeaderCFConnectingIP`
+// or `HeaderTrueClientIP`. Without it, only the connection's remote address is used.
+func IPExtractorHeader(header string) IPExtractorOption {
+	return func(e *IPExtractor) {
+		e.header = http.CanonicalHeaderKey(header)
+	}
+}
+
+// IPExtractorTrustedProxies sets the ranges of the proxies allowed to set the client
+// address header. For list headers (`X-Forwarded-For` and `Forwarded`), the client is the
+// right-most address not in those ranges.
+func IPExtractorTrustedProxies(prefixes ...netip.Prefix) IPExtractorOption {
+	return func(e *IPExtractor) {
+		e.trustedProxies = append(e.trustedProxies, prefixes...)
+	}
+}
+
+// IPExtractorHops sets the number of proxies in front of the service, the connection's
+// remote address being the last one. For list headers (`X-Forwarded-For` and `Forwarded`),
+// the client is the address right before those proxies. It is used instead of trusted
+// ranges when the proxies addresses are not known in advance.
+func IPExtractorHops(hops int) IPExtractorOption {
+	return func(e *IPExtractor) {
+		e.hops = hops
+	}
+}
+
+// IPExtractor determines the address of the client that initiated a request, reading the
+// configured header only when the request came through trusted proxies since any client
+// can send those headers.
+type IPExtractor struct {
+	header         string
+	trustedProxies []netip.Prefix
+	hops           int
+}
+
+func NewIPExtractor(opts ...IPExtractorOption) *IPExtractor {
+	e := &IPExtractor{}
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	return e
+}
+
+// NewGCLBIPExtractor creates an `IPExtractor` for services behind a Google Cloud Load
+// Balancer, which appends the client address and its own address to `X-Forwarded-For`.
+//
+// @see https://cloud.google.com/load-balancing/docs/https#x-forwarded-for_header
+func NewGCLBIPExtractor() *IPExtractor {
+	return NewIPExtractor(IPExtractorHeader(HeaderXForwardedFor), IPExtractorHops(2))
+}
+
+// NewCloudflareIPExtractor creates an `IPExtractor` for services directly behind Cloudflare,
+// trusting `CF-Connecting-IP` only on connections coming from Cloudflare's ranges.
+func NewCloudflareIPExtractor() *IPExtractor {
+	return NewIPExtractor(IPExtractorHeader(HeaderCFConnectingIP), IPExtractorTrustedProxies(CloudflareNetworks...))
+}
+
+// NewALBIPExtractor creates an `IPExtractor` for services behind an AWS Application Load
+// Balancer, which appends the client address to `X-Forwarded-For`.
+func NewALBIPExtractor() *IPExtractor {
+	return NewIPExtractor(IPExtractorHeader(HeaderXForwardedFor), IPExtractorHops(1))
+}
+
+// NewDirectIPExtractor creates an `IPExtractor` for services directly exposed to clients,
+// only the connection's remote address is used.
+func NewDirectIPExtractor() *IPExtractor {
+	return NewIPExtractor()
+}
+
+// ExtractIP returns the client address of the request, falling back to the connection's
+// remote address when the header cannot be trusted, is absent or does not hold a valid
+// address. IPv4-mapped IPv6 addresses are returned as IPv4 addresses.
+//
+// The returned address is invalid only if the connection's remote address is itself invalid.
+func (e *IPExtractor) ExtractIP(r *http.Request) netip.Addr {
+	remoteAddr, _ := parseIP(r.RemoteAddr)
+	if e.header == "" {
+		return remoteAddr
+	}
+
+	switch e.header {
+	case HeaderXForwardedFor, HeaderForwarded:
+		var entries []string
+		if e.header == HeaderForwarded {
+			entries = forwardedForValues(r.Header.Values(HeaderForwarded))
+		} else {
+			entries = listHeaderValues(r.Header.Values(HeaderXForwardedFor))
+		}
+
+		if len(entries) == 0 {
+			return remoteAddr
+		}
+
+		return e.clientFromChain(entries, remoteAddr)
+
+	default:
+		value := r.Header.Get(e.header)
+		if value == "" || !e.trustsConnection(remoteAddr) {
+			return remoteAddr
+		}
+
+		if addr, ok := parseIP(value); ok {
+			return addr
+		}
+
+		return remoteAddr
+	}
+}
+
+// ExtractIPString is `ExtractIP` returning the address as a string, empty if it's invalid.
+func (e *IPExtractor) ExtractIPString(r *http.Request) string {
+	return addrString(e.ExtractIP(r))
+}
+
+// clientFromChain picks the client from the header's entries followed by the connection's
+// remote address.
+func (e *IPExtractor) clientFromChain(entries []string, remoteAddr netip.Addr) netip.Addr {
+	if len(e.trustedProxies) > 0 {
+		if !e.isTrustedProxy(remoteAddr) {
+			return remoteAddr
+		}
+
+		for i := len(entries) - 1; i >= 0; i-- {
+			addr, ok := parseIP(entries[i])
+			if !ok {
+				// A garbage entry cannot come from a trusted proxy
+				return remoteAddr
+			}
+
+			if !e.isTrustedProxy(addr) || i == 0 {
+				// When all addresses are proxies, the left-most one is the closest to the client
+				return addr
+			}
+		}
+	}
+
+	if e.hops > 0 {
+		// The remote address is the last hop, so it's not part of `entries`
+		if index := len(entries) - e.hops; index >= 0 {
+			if addr, ok := parseIP(entries[index]); ok {
+				return addr
+			}
+		}
+	}
+
+	return remoteAddr
+}
+
+// trustsConnection returns whether the connection comes from a proxy allowed to set
+// single address headers.
+func (e *IPExtractor) trustsConnection(remoteAddr netip.Addr) bool {
+	if len(e.trustedProxies) > 0 {
+		return e.isTrustedProxy(remoteAddr)
+	}
+
+	return e.hops > 0
+}
+
+func (e *IPExtractor) isTrustedProxy(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+
+	// Prefixes never contain zoned addresses
+	addr = addr.WithZone("")
+	for _, prefix := range e.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseIP parses an address optionally followed by a port, like `192.0.2.1`, `192.0.2.1:80`,
+// `2001:db8::1`, `[2001:db8::1]:80` or `[fe80::1%eth0]`. IPv4-mapped IPv6 addresses are
+// converted to IPv4 addresses.
+func parseIP(value string) (netip.Addr, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return netip.Addr{}, false
+	}
+
+	if strings.HasPrefix(value, "[") {
+		end := strings.Index(value, "]")
+		if end == -1 {
+			return netip.Addr{}, false
+		}
+
+		rest := value[end+1:]
+		if rest != "" && !isPortSuffix(rest) {
+			return netip.Addr{}, false
+		}
+
+		value = value[1:end]
+	} else if host, port, found := strings.Cut(value, ":"); found && !strings.Contains(port, ":") {
+		// A single colon is an IPv4 address with a port, IPv6 addresses have at least two
+		if !isPortSuffix(":" + port) {
+			return netip.Addr{}, false
+		}
+
+		value = host
+	}
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addr.Unmap(), true
+}
+
+func isPortSuffix(value string) bool {
+	if len(value) < 2 || value[0] != ':' {
+		return false
+	}
+
+	for _, c := range value[1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func addrString(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return ""
+	}
+
+	return addr.String()
+}
+
+func listHeaderValues(values []string) (out []string) {
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			out = append(out, strings.TrimSpace(entry))
+		}
+	}
+
+	return out
+}
+
+// forwardedForValues extracts the `for` parameter of each element of `Forwarded` headers,
+// brackets and ports are left for `parseIP` to handle.
+//
+// @see https://www.rfc-editor.org/rfc/rfc7239
+func forwardedForValues(values []string) (out []string) {
+	for _, element := range listHeaderValues(values) {
+		node := ""
+		for _, pair := range strings.Split(element, ";") {
+			name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if found && strings.EqualFold(name, "for") {
+				node = strings.Trim(value, `"`)
+			}
+		}
+
+		out = append(out, node)
+	}
+
+	return out
+}
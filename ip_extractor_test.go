@@ -0,0 +1,180 @@
+package dhttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPExtractor(t *testing.T) {
+	tests := []struct {
+		name       string
+		extractor  *IPExtractor
+		remoteAddr string
+		header     http.Header
+		expected   string
+	}{
+		{
+			"direct ignores headers",
+			NewDirectIPExtractor(),
+			"1.1.1.1:1234",
+			http.Header{"X-Forwarded-For": []string{"2.2.2.2"}, "X-Real-Ip": []string{"3.3.3.3"}},
+			"1.1.1.1",
+		},
+		{
+			"alb",
+			NewALBIPExtractor(),
+			"10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": []string{"6.6.6.6, 2.2.2.2"}},
+			"2.2.2.2",
+		},
+		{
+			"alb without header",
+			NewALBIPExtractor(),
+			"10.0.0.1:1234",
+			http.Header{},
+			"10.0.0.1",
+		},
+		{
+			"gclb multiple headers",
+			NewGCLBIPExtractor(),
+			"10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": []string{"6.6.6.6", "2.2.2.2, 35.0.0.1"}},
+			"2.2.2.2",
+		},
+		{
+			"cloudflare from cloudflare",
+			NewCloudflareIPExtractor(),
+			"173.245.48.10:1234",
+			http.Header{"Cf-Connecting-Ip": []string{"2.2.2.2"}},
+			"2.2.2.2",
+		},
+		{
+			"cloudflare from elsewhere",
+			NewCloudflareIPExtractor(),
+			"1.1.1.1:1234",
+			http.Header{"Cf-Connecting-Ip": []string{"2.2.2.2"}},
+			"1.1.1.1",
+		},
+		{
+			"trusted proxies skips proxies from the right",
+			NewIPExtractor(IPExtractorHeader(HeaderXForwardedFor), IPExtractorTrustedProxies(PrivateNetworks...)),
+			"127.0.0.1:1234",
+			http.Header{"X-Forwarded-For": []string{"6.6.6.6, 2.2.2.2, 10.1.1.1, 192.168.1.1"}},
+			"2.2.2.2",
+		},
+		{
+			"trusted proxies all trusted",
+			NewIPExtractor(IPExtractorHeader(HeaderXForwardedFor), IPExtractorTrustedProxies(PrivateNetworks...)),
+			"127.0.0.1:1234",
+			http.Header{"X-Forwarded-For": []string{"10.1.1.1, 192.168.1.1"}},
+			"10.1.1.1",
+		},
+		{
+			"x-real-ip from trusted proxy",
+			NewIPExtractor(IPExtractorHeader(HeaderXRealIP), IPExtractorTrustedProxies(netip.MustParsePrefix("10.0.0.0/8"))),
+			"10.0.0.1:1234",
+			http.Header{"X-Real-Ip": []string{"2.2.2.2"}},
+			"2.2.2.2",
+		},
+		{
+			"true-client-ip with hops",
+			NewIPExtractor(IPExtractorHeader(HeaderTrueClientIP), IPExtractorHops(1)),
+			"10.0.0.1:1234",
+			http.Header{"True-Client-Ip": []string{"2.2.2.2"}},
+			"2.2.2.2",
+		},
+		{
+			"forwarded",
+			NewIPExtractor(IPExtractorHeader(HeaderForwarded), IPExtractorHops(1)),
+			"10.0.0.1:1234",
+			http.Header{"Forwarded": []string{`for=6.6.6.6, for="[2001:db8:cafe::17]:4711";proto=https`}},
+			"2001:db8:cafe::17",
+		},
+		{
+			"forwarded with port",
+			NewIPExtractor(IPExtractorHeader(HeaderForwarded), IPExtractorHops(1)),
+			"10.0.0.1:1234",
+			http.Header{"Forwarded": []string{`proto=http;for="192.0.2.43:47011";by=203.0.113.43`}},
+			"192.0.2.43",
+		},
+		{
+			"invalid header entry falls back to remote address",
+			NewGCLBIPExtractor(),
+			"10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": []string{"<script>, 35.0.0.1"}},
+			"10.0.0.1",
+		},
+		{
+			"invalid single header falls back to remote address",
+			NewIPExtractor(IPExtractorHeader(HeaderXRealIP), IPExtractorHops(1)),
+			"10.0.0.1:1234",
+			http.Header{"X-Real-Ip": []string{"unknown"}},
+			"10.0.0.1",
+		},
+		{
+			"bracketed IPv6 remote address",
+			NewDirectIPExtractor(),
+			"[::1]:8080",
+			http.Header{},
+			"::1",
+		},
+		{
+			"IPv4-mapped remote address",
+			NewDirectIPExtractor(),
+			"[::ffff:192.0.2.1]:8080",
+			http.Header{},
+			"192.0.2.1",
+		},
+		{
+			"trusted IPv4-mapped proxy",
+			NewIPExtractor(IPExtractorHeader(HeaderXForwardedFor), IPExtractorTrustedProxies(PrivateNetworks...)),
+			"[::ffff:10.0.0.1]:8080",
+			http.Header{"X-Forwarded-For": []string{" 2.2.2.2 , 10.1.1.1 "}},
+			"2.2.2.2",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "/", nil)
+			request.RemoteAddr = test.remoteAddr
+			request.Header = test.header
+
+			assert.Equal(t, test.expected, test.extractor.ExtractIPString(request))
+		})
+	}
+}
+
+func Test_parseIP(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{" 192.0.2.1 ", "192.0.2.1"},
+		{"192.0.2.1:8080", "192.0.2.1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"[2001:db8::1]:8080", "2001:db8::1"},
+		{"fe80::1%eth0", "fe80::1%eth0"},
+		{"[fe80::1%eth0]:8080", "fe80::1%eth0"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{"", ""},
+		{"unknown", ""},
+		{"_hidden", ""},
+		{"192.0.2.1:port", ""},
+		{"[2001:db8::1", ""},
+		{"[2001:db8::1]garbage", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			addr, _ := parseIP(test.input)
+			assert.Equal(t, test.expected, addrString(addr))
+		})
+	}
+}
@@ -3,6 +3,7 @@ package dhttp
 import (
 	"fmt"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"regexp"
 	"strings"
@@ -26,10 +27,12 @@ var zlog, _ = logging.PackageLogger("dhttp", "github.com/streamingfast/dhttp")
 // and if tracing is enabled, the full request is dumped to the logger, in a multi-line
 // log.
 //
-// If debug is enabled, a one-line Response log containing HTTP status and body length is logged,
-// and if tracing is enabled, the full request is dumped to the logger, in a multi-line
-// log.
+// If debug is enabled, a one-line Response log containing HTTP status, body length, total duration
+// and time to first byte is logged, and if tracing is enabled, the full request is dumped to the
+// logger, in a multi-line log, along with the DNS, connect and TLS timing breakdown.
 //
+// If debug is enabled and the transport fails, the error is logged alongside its class (one of
+// `timeout`, `dns`, `connection_refused`, `tls`, `cancelled` or `unknown`).
 
 func NewLoggingRoundTripper(logger *zap.Logger, tracer logging.Tracer, next http.RoundTripper) *LoggingRoundTripper {
 	if next == nil {
@@ -53,6 +56,7 @@ func (t *LoggingRoundTripper) RoundTrip(request *http.Request) (*http.Response,
 	logger := logging.Logger(request.Context(), t.logger)
 	debugEnabled := logger.Core().Enabled(zap.DebugLevel)
 
+	var timings *clientTimings
 	if debugEnabled {
 		traceEnabled := t.tracer.Enabled()
 
@@ -66,25 +70,48 @@ func (t *LoggingRoundTripper) RoundTrip(request *http.Request) (*http.Response,
 		} else {
 			logger.Debug(fmt.Sprintf("HTTP request %s %s", request.Method, request.URL.String()), zap.Array("headers", zapHeaders(request.Header)))
 		}
+
+		timings = newClientTimings()
+		request = request.WithContext(httptrace.WithClientTrace(request.Context(), timings.clientTrace()))
 	}
 
 	response, err := t.transport.RoundTrip(request)
 	if err != nil {
+		if debugEnabled {
+			logger.Debug(fmt.Sprintf("HTTP request %s %s failed after %s", request.Method, request.URL.String(), timings.elapsed()),
+				zap.String("error_class", classifyTransportError(err)),
+				zap.Duration("duration", timings.elapsed()),
+				zap.Error(err),
+			)
+		}
+
 		return nil, err
 	}
 
 	if debugEnabled {
 		traceEnabled := t.tracer.Enabled()
+		duration := timings.elapsed()
 
 		if traceEnabled {
+			fields := timings.zapFields()
+
 			responseDump, err := httputil.DumpResponse(response, true)
 			if err != nil {
-				logger.Debug(fmt.Sprintf("HTTP response %s (%d bytes, unable to log response body: %s)", response.Status, response.ContentLength, err))
+				logger.Debug(fmt.Sprintf("HTTP response %s (%d bytes in %s, unable to log response body: %s)", response.Status, response.ContentLength, duration, err), fields...)
 			} else {
-				logger.Debug("HTTP response\n" + string(responseDump))
+				logger.Debug(fmt.Sprintf("HTTP response in %s\n", duration)+string(responseDump), fields...)
 			}
 		} else {
-			logger.Debug(fmt.Sprintf("HTTP response %s (%d bytes)", response.Status, response.ContentLength))
+			fields := []zap.Field{
+				zap.Duration("duration", duration),
+				zap.Duration("time_to_first_byte", timings.timeToFirstByte()),
+			}
+
+			if cacheStatus := response.Header.Get(CacheStatusHeader); cacheStatus != "" {
+				fields = append(fields, zap.String("cache", cacheStatus))
+			}
+
+			logger.Debug(fmt.Sprintf("HTTP response %s (%d bytes in %s)", response.Status, response.ContentLength, duration), fields...)
 		}
 	}
 
@@ -0,0 +1,58 @@
+package dhttp
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+type testTracer bool
+
+func (t testTracer) Enabled() bool { return bool(t) }
+
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestLoggingRoundTripper_Duration(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	core, logs := observer.New(zap.DebugLevel)
+	client := &http.Client{Transport: NewLoggingRoundTripper(zap.New(core), testTracer(false), nil)}
+
+	response, err := client.Get(server.URL)
+	require.NoError(t, err)
+	response.Body.Close()
+
+	entries := logs.FilterMessageSnippet("HTTP response").All()
+	require.Len(t, entries, 1)
+
+	fields := entries[0].ContextMap()
+	assert.Contains(t, fields, "duration")
+	assert.Contains(t, fields, "time_to_first_byte")
+}
+
+func TestLoggingRoundTripper_TransportError(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("boom")
+	})
+
+	client := &http.Client{Transport: NewLoggingRoundTripper(zap.New(core), testTracer(false), transport)}
+
+	_, err := client.Get("http://localhost/")
+	require.Error(t, err)
+
+	entries := logs.FilterMessageSnippet("failed").All()
+	require.Len(t, entries, 1)
+	assert.Equal(t, transportErrorUnknown, entries[0].ContextMap()["error_class"])
+}
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/streamingfast/dhttp"
+)
+
+type BodyLimitOption func(m *bodyLimitMiddleware)
+
+// BodyLimitContentType overrides the limit for requests of the given media type, like
+// `application/json`, or of a whole type, like `image/*`. Exact media types take precedence
+// over whole types.
+func BodyLimitContentType(mediaType string, limit int64) BodyLimitOption {
+	return func(m *bodyLimitMiddleware) {
+		m.contentTypes[strings.ToLower(mediaType)] = limit
+	}
+}
+
+// BodyLimitRoute overrides the limit for the `mux` route named `name`, it takes precedence
+// over content type overrides.
+func BodyLimitRoute(name string, limit int64) BodyLimitOption {
+	return func(m *bodyLimitMiddleware) {
+		m.routes[name] = limit
+	}
+}
+
+// NewBodyLimitMiddleware limits the size of request bodies to `limit` bytes, a limit lower
+// or equal to 0 meaning no limit. Requests announcing a bigger `Content-Length` are rejected
+// right away with a derr `413 Request Entity Too Large` error, others have their body
+// wrapped with `http.MaxBytesReader`.
+//
+// Reading past the limit fails with an `*http.MaxBytesError` which `dhttp.ExtractJSONRequest`
+// and `dhttp.WriteError` turn into the same derr `413 Request Entity Too Large` error.
+func NewBodyLimitMiddleware(limit int64, opts ...BodyLimitOption) mux.MiddlewareFunc {
+	m := &bodyLimitMiddleware{
+		limit:        limit,
+		contentTypes: map[string]int64{},
+		routes:       map[string]int64{},
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit := m.requestLimit(r)
+			if limit <= 0 || r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if r.ContentLength > limit {
+				ctx := r.Context()
+				dhttp.WriteError(ctx, w, dhttp.RequestBodyTooLargeError(ctx, fmt.Errorf("content length %d exceeds limit", r.ContentLength), limit))
+				return
+			}
+
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type bodyLimitMiddleware struct {
+	limit        int64
+	contentTypes map[string]int64
+	routes       map[string]int64
+}
+
+func (m *bodyLimitMiddleware) requestLimit(r *http.Request) int64 {
+	if route := mux.CurrentRoute(r); route != nil {
+		if limit, found := m.routes[route.GetName()]; found {
+			return limit
+		}
+	}
+
+	if len(m.contentTypes) > 0 {
+		if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil {
+			if limit, found := m.contentTypes[mediaType]; found {
+				return limit
+			}
+
+			if mainType, _, found := strings.Cut(mediaType, "/"); found {
+				if limit, found := m.contentTypes[mainType+"/*"]; found {
+					return limit
+				}
+			}
+		}
+	}
+
+	return m.limit
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/streamingfast/dhttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBodyLimitMiddleware(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(NewBodyLimitMiddleware(10,
+		BodyLimitContentType("image/*", 20),
+		BodyLimitContentType("image/svg+xml", 5),
+		BodyLimitRoute("upload", 30),
+	))
+
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			dhttp.WriteError(r.Context(), w, err)
+			return
+		}
+
+		w.Write(body)
+	}
+	router.Path("/").HandlerFunc(echo)
+	router.Path("/upload").Name("upload").HandlerFunc(echo)
+
+	tests := []struct {
+		name         string
+		path         string
+		contentType  string
+		size         int
+		hideLength   bool
+		expectedCode int
+	}{
+		{"under default", "/", "application/json", 10, false, http.StatusOK},
+		{"over default", "/", "application/json", 11, false, http.StatusRequestEntityTooLarge},
+		{"over default unknown length", "/", "application/json", 11, true, http.StatusRequestEntityTooLarge},
+		{"whole type override", "/", "image/png", 20, false, http.StatusOK},
+		{"media type override", "/", "image/svg+xml; charset=utf-8", 6, false, http.StatusRequestEntityTooLarge},
+		{"route override", "/upload", "image/svg+xml", 30, true, http.StatusOK},
+		{"over route override", "/upload", "image/svg+xml", 31, true, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var body io.Reader = strings.NewReader(strings.Repeat("a", test.size))
+			if test.hideLength {
+				body = io.MultiReader(body)
+			}
+
+			request := httptest.NewRequest("POST", test.path, body)
+			request.Header.Set("Content-Type", test.contentType)
+
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+
+			assert.Equal(t, test.expectedCode, recorder.Code)
+			if test.expectedCode == http.StatusRequestEntityTooLarge {
+				assert.Contains(t, recorder.Body.String(), string(dhttp.RequestBodyTooLargeErrorCode))
+			}
+		})
+	}
+}
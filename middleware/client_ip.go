@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/streamingfast/dhttp"
+	"github.com/streamingfast/logging"
+	"go.uber.org/zap"
+)
+
+type clientIPKey struct{}
+
+// ClientIPFromContext returns the client address resolved by `NewClientIPMiddleware`,
+// `false` if the middleware did not run or could not resolve it.
+func ClientIPFromContext(ctx context.Context) (netip.Addr, bool) {
+	addr, found := ctx.Value(clientIPKey{}).(netip.Addr)
+	return addr, found && addr.IsValid()
+}
+
+type ClientIPOption func(m *clientIPMiddleware)
+
+// ClientIPRewriteRemoteAddr replaces the request's `RemoteAddr` by the resolved client
+// address, keeping the connection's port, so code relying on `RemoteAddr` sees the client.
+func ClientIPRewriteRemoteAddr() ClientIPOption {
+	return func(m *clientIPMiddleware) {
+		m.rewriteRemoteAddr = true
+	}
+}
+
+// NewClientIPMiddleware resolves the client address once per request using `extractor`,
+// `dhttp.DefaultIPExtractor` if `nil`, and stores it in the request's context, retrieve it
+// with `ClientIPFromContext`. The address is also added as the `client_ip` field of the
+// request specific logger, install it after `NewTracingLoggingMiddleware` to extend its
+// logger.
+func NewClientIPMiddleware(logger *zap.Logger, extractor *dhttp.IPExtractor, opts ...ClientIPOption) mux.MiddlewareFunc {
+	m := &clientIPMiddleware{logger: logger, extractor: extractor}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, m.resolve(r))
+		})
+	}
+}
+
+type clientIPMiddleware struct {
+	logger            *zap.Logger
+	extractor         *dhttp.IPExtractor
+	rewriteRemoteAddr bool
+}
+
+func (m *clientIPMiddleware) resolve(r *http.Request) *http.Request {
+	extractor := m.extractor
+	if extractor == nil {
+		// Resolved on each request since it may be replaced after the middleware is created
+		extractor = dhttp.DefaultIPExtractor
+	}
+
+	addr := extractor.ExtractIP(r)
+	if !addr.IsValid() {
+		return r
+	}
+
+	ctx := context.WithValue(r.Context(), clientIPKey{}, addr)
+	ctx = logging.WithLogger(ctx, logging.Logger(ctx, m.logger).With(zap.Stringer("client_ip", addr)))
+
+	r = r.WithContext(ctx)
+	if m.rewriteRemoteAddr {
+		port := "0"
+		if _, remotePort, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			port = remotePort
+		}
+
+		if parsedPort, err := strconv.ParseUint(port, 10, 16); err == nil {
+			r.RemoteAddr = netip.AddrPortFrom(addr, uint16(parsedPort)).String()
+		}
+	}
+
+	return r
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/streamingfast/dhttp"
+	"github.com/streamingfast/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestClientIPMiddleware(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+
+	router := mux.NewRouter()
+	router.Use(NewClientIPMiddleware(zap.New(core), dhttp.NewALBIPExtractor(), ClientIPRewriteRemoteAddr()))
+	router.Path("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, found := ClientIPFromContext(r.Context())
+		require.True(t, found)
+		assert.Equal(t, "2.2.2.2", addr.String())
+		assert.Equal(t, "2.2.2.2:5000", r.RemoteAddr)
+
+		logging.Logger(r.Context(), zap.NewNop()).Info("handled")
+	})
+
+	request := httptest.NewRequest("GET", "/", nil)
+	request.RemoteAddr = "10.0.0.1:5000"
+	request.Header.Set("X-Forwarded-For", "2.2.2.2")
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	require.Equal(t, 1, logs.Len())
+	assert.Equal(t, "2.2.2.2", logs.All()[0].ContextMap()["client_ip"])
+}
+
+func TestClientIPFromContext_Missing(t *testing.T) {
+	_, found := ClientIPFromContext(httptest.NewRequest("GET", "/", nil).Context())
+	assert.False(t, found)
+}
@@ -1,15 +1,316 @@
 package middleware
 
 import (
-	"github.com/gorilla/handlers"
-	"github.com/gorilla/mux"
+	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/streamingfast/logging"
+	"go.uber.org/zap"
 )
 
-func NewCORSMiddleware(allowedOrigins string) mux.MiddlewareFunc {
-	return handlers.CORS(
-		handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization"}),
-		handlers.AllowedOrigins(strings.Split(allowedOrigins, ",")),
-		handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"}),
-	)
+// corsSimpleHeaders are the request headers always allowed by browsers, they never need to
+// be explicitly allowed.
+var corsSimpleHeaders = []string{"Accept", "Accept-Language", "Content-Language", "Origin"}
+
+type CORSOption func(c *corsConfig)
+
+// CORSAllowedOrigins adds allowed origins, an origin is either `*` to allow any origin, an
+// exact origin like `https://app.example.com` or a wildcard subdomain origin like
+// `https://*.example.com`, which does not match `https://example.com` itself.
+func CORSAllowedOrigins(origins ...string) CORSOption {
+	return func(c *corsConfig) {
+		for _, origin := range origins {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				c.allowedOrigins = append(c.allowedOrigins, strings.ToLower(origin))
+			}
+		}
+	}
+}
+
+// CORSAllowedOriginPatterns adds allowed origins as regular expressions, each pattern must
+// match the whole origin.
+func CORSAllowedOriginPatterns(patterns ...*regexp.Regexp) CORSOption {
+	return func(c *corsConfig) {
+		for _, pattern := range patterns {
+			c.allowedOriginPatterns = append(c.allowedOriginPatterns, regexp.MustCompile(`^(?:`+pattern.String()+`)$`))
+		}
+	}
+}
+
+// CORSAllowedMethods sets the allowed methods, defaults to `GET`, `HEAD`, `POST`, `PUT`,
+// `DELETE` and `OPTIONS`.
+func CORSAllowedMethods(methods ...string) CORSOption {
+	return func(c *corsConfig) {
+		c.allowedMethods = nil
+		for _, method := range methods {
+			c.allowedMethods = append(c.allowedMethods, strings.ToUpper(method))
+		}
+	}
+}
+
+// CORSAllowedHeaders sets the allowed request headers, defaults to `X-Requested-With`,
+// `Content-Type` and `Authorization`. The `Accept`, `Accept-Language`, `Content-Language`
+// and `Origin` headers are always allowed.
+func CORSAllowedHeaders(headers ...string) CORSOption {
+	return func(c *corsConfig) {
+		c.allowedHeaders = nil
+		for _, header := range headers {
+			c.allowedHeaders = append(c.allowedHeaders, http.CanonicalHeaderKey(header))
+		}
+	}
+}
+
+// CORSExposedHeaders sets the response headers readable by the browser's script besides
+// the CORS-safelisted ones.
+func CORSExposedHeaders(headers ...string) CORSOption {
+	return func(c *corsConfig) {
+		c.exposedHeaders = nil
+		for _, header := range headers {
+			c.exposedHeaders = append(c.exposedHeaders, http.CanonicalHeaderKey(header))
+		}
+	}
+}
+
+// CORSAllowCredentials allows requests with credentials (cookies, authorization headers or
+// TLS client certificates). The request's origin is then echoed back even when any origin
+// is allowed, since browsers reject a `*` origin for those requests.
+func CORSAllowCredentials() CORSOption {
+	return func(c *corsConfig) {
+		c.allowCredentials = true
+	}
+}
+
+// CORSMaxAge sets for how long browsers may cache the result of a preflight request, not
+// sent by default.
+func CORSMaxAge(maxAge time.Duration) CORSOption {
+	return func(c *corsConfig) {
+		c.maxAge = maxAge
+	}
+}
+
+// CORSRoute overrides the configuration for the `mux` route named `name`, the override
+// options are applied on top of the middleware's ones.
+func CORSRoute(name string, opts ...CORSOption) CORSOption {
+	return func(c *corsConfig) {
+		if c.routes == nil {
+			c.routes = map[string][]CORSOption{}
+		}
+
+		c.routes[name] = append(c.routes[name], opts...)
+	}
+}
+
+// CORSLogger sets the logger used to explain rejected CORS requests at debug level, the
+// request specific logger is used if one exists in the request's context.
+func CORSLogger(logger *zap.Logger) CORSOption {
+	return func(c *corsConfig) {
+		c.logger = logger
+	}
+}
+
+// NewCORSMiddleware handles Cross-Origin Resource Sharing for the comma separated
+// `allowedOrigins` (see `CORSAllowedOrigins` for their format) and those configured
+// through `opts`.
+//
+// Preflight requests are answered directly with a `204 No Content` response, without
+// CORS headers when rejected, in which case the reason is logged at debug level. Since
+// `mux` runs middlewares only on matched routes, routes must accept the `OPTIONS` method
+// for their preflight requests to reach the middleware.
+//
+// Unless any origin is allowed without credentials, responses carry a `Vary: Origin`
+// header since they depend on the request's origin.
+func NewCORSMiddleware(allowedOrigins string, opts ...CORSOption) mux.MiddlewareFunc {
+	config := newCORSConfig(append([]CORSOption{CORSAllowedOrigins(strings.Split(allowedOrigins, ",")...)}, opts...))
+
+	routes := map[string]*corsConfig{}
+	for name, routeOpts := range config.routes {
+		routes[name] = newCORSConfig(append(append([]CORSOption{CORSAllowedOrigins(strings.Split(allowedOrigins, ",")...)}, opts...), routeOpts...))
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c := config
+			if route := mux.CurrentRoute(r); route != nil {
+				if routeConfig, found := routes[route.GetName()]; found {
+					c = routeConfig
+				}
+			}
+
+			if c.handle(w, r) {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+type corsConfig struct {
+	allowedOrigins        []string
+	allowedOriginPatterns []*regexp.Regexp
+	allowedMethods        []string
+	allowedHeaders        []string
+	exposedHeaders        []string
+	allowCredentials      bool
+	maxAge                time.Duration
+	routes                map[string][]CORSOption
+	logger                *zap.Logger
+
+	allowAnyOrigin bool
+}
+
+func newCORSConfig(opts []CORSOption) *corsConfig {
+	c := &corsConfig{
+		allowedMethods: []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"},
+		allowedHeaders: []string{"X-Requested-With", "Content-Type", "Authorization"},
+		logger:         zlog,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	for _, origin := range c.allowedOrigins {
+		if origin == "*" {
+			c.allowAnyOrigin = true
+		}
+	}
+
+	return c
+}
+
+// handle applies CORS to the request, returning whether the next handler must be invoked.
+func (c *corsConfig) handle(w http.ResponseWriter, r *http.Request) bool {
+	header := w.Header()
+	if !c.allowAnyOrigin || c.allowCredentials {
+		header.Add("Vary", "Origin")
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	requestMethod := r.Header.Get("Access-Control-Request-Method")
+	if r.Method != http.MethodOptions || requestMethod == "" {
+		if c.isAllowedOrigin(origin) {
+			c.setAllowOrigin(header, origin)
+			if len(c.exposedHeaders) > 0 {
+				header.Set("Access-Control-Expose-Headers", strings.Join(c.exposedHeaders, ", "))
+			}
+		} else {
+			logging.Logger(r.Context(), c.logger).Debug("CORS request origin not allowed", zap.String("origin", origin))
+		}
+
+		return true
+	}
+
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+
+	if reason := c.rejectPreflight(origin, requestMethod, r.Header.Values("Access-Control-Request-Headers")); reason != "" {
+		logging.Logger(r.Context(), c.logger).Debug("CORS preflight request rejected",
+			zap.String("reason", reason),
+			zap.String("origin", origin),
+			zap.String("method", requestMethod),
+			zap.Strings("headers", r.Header.Values("Access-Control-Request-Headers")),
+		)
+
+		w.WriteHeader(http.StatusNoContent)
+		return false
+	}
+
+	c.setAllowOrigin(header, origin)
+	header.Set("Access-Control-Allow-Methods", strings.Join(c.allowedMethods, ", "))
+	if requestHeaders := headerList(r.Header.Values("Access-Control-Request-Headers")); len(requestHeaders) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(requestHeaders, ", "))
+	}
+
+	if c.maxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(c.maxAge.Seconds())))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return false
+}
+
+// rejectPreflight returns why the preflight request is rejected, empty if it's allowed.
+func (c *corsConfig) rejectPreflight(origin string, method string, requestHeaders []string) string {
+	if !c.isAllowedOrigin(origin) {
+		return "origin not allowed"
+	}
+
+	if !contains(c.allowedMethods, strings.ToUpper(method)) {
+		return "method not allowed"
+	}
+
+	for _, requestHeader := range headerList(requestHeaders) {
+		if !contains(c.allowedHeaders, requestHeader) && !contains(corsSimpleHeaders, requestHeader) {
+			return "header " + requestHeader + " not allowed"
+		}
+	}
+
+	return ""
+}
+
+func (c *corsConfig) setAllowOrigin(header http.Header, origin string) {
+	if c.allowAnyOrigin && !c.allowCredentials {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if c.allowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (c *corsConfig) isAllowedOrigin(origin string) bool {
+	if c.allowAnyOrigin {
+		return true
+	}
+
+	lowerOrigin := strings.ToLower(origin)
+	for _, allowed := range c.allowedOrigins {
+		if prefix, suffix, found := strings.Cut(allowed, "*"); found {
+			if len(lowerOrigin) > len(prefix)+len(suffix) && strings.HasPrefix(lowerOrigin, prefix) && strings.HasSuffix(lowerOrigin, suffix) &&
+				!strings.ContainsAny(lowerOrigin[len(prefix):len(lowerOrigin)-len(suffix)], "/:") {
+				return true
+			}
+		} else if lowerOrigin == allowed {
+			return true
+		}
+	}
+
+	for _, pattern := range c.allowedOriginPatterns {
+		if pattern.MatchString(origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func headerList(values []string) (out []string) {
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				out = append(out, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	return out
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+
+	return false
 }
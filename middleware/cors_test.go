@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestCORSMiddleware(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+
+	router := mux.NewRouter()
+	router.Use(NewCORSMiddleware("https://app.example.com, https://*.example.org",
+		CORSAllowedOriginPatterns(regexp.MustCompile(`https://preview-[0-9]+\.example\.net`)),
+		CORSAllowedHeaders("Content-Type", "X-Custom"),
+		CORSExposedHeaders("X-Request-Id"),
+		CORSAllowCredentials(),
+		CORSMaxAge(10*time.Minute),
+		CORSRoute("public", CORSAllowedOrigins("*")),
+		CORSLogger(zap.New(core)),
+	))
+	router.Methods("GET", "OPTIONS").Path("/private").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("private"))
+	})
+	router.Methods("GET", "OPTIONS").Path("/public").Name("public").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("public"))
+	})
+
+	serve := func(method, path string, header http.Header) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, nil)
+		request.Header = header
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	t.Run("allowed origins", func(t *testing.T) {
+		for _, origin := range []string{"https://app.example.com", "https://a.example.org", "https://a.b.example.org", "https://preview-12.example.net"} {
+			recorder := serve("GET", "/private", http.Header{"Origin": []string{origin}})
+
+			assert.Equal(t, "private", recorder.Body.String())
+			assert.Equal(t, origin, recorder.Header().Get("Access-Control-Allow-Origin"), origin)
+			assert.Equal(t, "true", recorder.Header().Get("Access-Control-Allow-Credentials"))
+			assert.Equal(t, "X-Request-Id", recorder.Header().Get("Access-Control-Expose-Headers"))
+			assert.Equal(t, []string{"Origin"}, recorder.Header().Values("Vary"))
+		}
+	})
+
+	t.Run("rejected origins", func(t *testing.T) {
+		for _, origin := range []string{"https://example.org", "https://evil.com", "https://preview-12.example.net.evil.com", "https://evil.com/.example.org"} {
+			recorder := serve("GET", "/private", http.Header{"Origin": []string{origin}})
+
+			assert.Equal(t, "private", recorder.Body.String())
+			assert.Empty(t, recorder.Header().Get("Access-Control-Allow-Origin"), origin)
+		}
+	})
+
+	t.Run("preflight", func(t *testing.T) {
+		recorder := serve("OPTIONS", "/private", http.Header{
+			"Origin":                         []string{"https://app.example.com"},
+			"Access-Control-Request-Method":  []string{"PUT"},
+			"Access-Control-Request-Headers": []string{"content-type, x-custom"},
+		})
+
+		assert.Equal(t, http.StatusNoContent, recorder.Code)
+		assert.Empty(t, recorder.Body.String())
+		assert.Equal(t, "https://app.example.com", recorder.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "Content-Type, X-Custom", recorder.Header().Get("Access-Control-Allow-Headers"))
+		assert.Equal(t, "600", recorder.Header().Get("Access-Control-Max-Age"))
+	})
+
+	t.Run("preflight rejected", func(t *testing.T) {
+		recorder := serve("OPTIONS", "/private", http.Header{
+			"Origin":                         []string{"https://app.example.com"},
+			"Access-Control-Request-Method":  []string{"GET"},
+			"Access-Control-Request-Headers": []string{"X-Other"},
+		})
+
+		assert.Equal(t, http.StatusNoContent, recorder.Code)
+		assert.Empty(t, recorder.Header().Get("Access-Control-Allow-Origin"))
+
+		rejections := logs.FilterMessage("CORS preflight request rejected").All()
+		require.Len(t, rejections, 1)
+		assert.Equal(t, "header X-Other not allowed", rejections[0].ContextMap()["reason"])
+	})
+
+	t.Run("route override", func(t *testing.T) {
+		recorder := serve("GET", "/public", http.Header{"Origin": []string{"https://anywhere.com"}})
+
+		assert.Equal(t, "https://anywhere.com", recorder.Header().Get("Access-Control-Allow-Origin"))
+	})
+}
+
+func TestCORSMiddleware_AnyOrigin(t *testing.T) {
+	handler := NewCORSMiddleware("*")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Origin", "https://anywhere.com")
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	assert.Equal(t, "*", recorder.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, recorder.Header().Get("Vary"))
+}
@@ -0,0 +1,247 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/streamingfast/derr"
+	"github.com/streamingfast/dhttp"
+)
+
+// NonceStore remembers the nonces of verified requests to reject replayed ones.
+type NonceStore interface {
+	// CheckAndStore returns `false` if the nonce was already seen, otherwise it stores
+	// the nonce until `expiresAt` and returns `true`.
+	CheckAndStore(nonce string, expiresAt time.Time) bool
+}
+
+// MemoryNonceStore is an in-memory `NonceStore`, suitable when a single instance
+// verifies requests.
+type MemoryNonceStore struct {
+	lock      sync.Mutex
+	nonces    map[string]time.Time
+	lastPurge time.Time
+}
+
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{nonces: map[string]time.Time{}}
+}
+
+func (s *MemoryNonceStore) CheckAndStore(nonce string, expiresAt time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastPurge) > time.Minute {
+		for candidate, candidateExpiresAt := range s.nonces {
+			if now.After(candidateExpiresAt) {
+				delete(s.nonces, candidate)
+			}
+		}
+
+		s.lastPurge = now
+	}
+
+	if existingExpiresAt, found := s.nonces[nonce]; found && now.Before(existingExpiresAt) {
+		return false
+	}
+
+	s.nonces[nonce] = expiresAt
+	return true
+}
+
+type HMACVerificationOption func(v *hmacVerifier)
+
+// HMACMaxClockSkew sets the maximum difference between the request's signature timestamp
+// and the local clock, defaults to 5 minutes.
+func HMACMaxClockSkew(skew time.Duration) HMACVerificationOption {
+	return func(v *hmacVerifier) {
+		v.maxClockSkew = skew
+	}
+}
+
+// HMACNonces sets the store used for replay protection, defaults to a `MemoryNonceStore`.
+func HMACNonces(store NonceStore) HMACVerificationOption {
+	return func(v *hmacVerifier) {
+		v.nonces = store
+	}
+}
+
+// HMACMaxBodySize sets the maximum size of a request body that can be verified, defaults
+// to 10 MiB.
+func HMACMaxBodySize(maxBodySize int64) HMACVerificationOption {
+	return func(v *hmacVerifier) {
+		v.maxBodySize = maxBodySize
+	}
+}
+
+// HMACRequiredHeaders sets the request headers that must be part of the signature,
+// replacing `dhttp.DefaultHMACSignedHeaders`. Signatures leaving one of them out are
+// rejected, otherwise a client could exclude a header from the signature and alter it.
+func HMACRequiredHeaders(headers ...string) HMACVerificationOption {
+	return func(v *hmacVerifier) {
+		v.requiredHeaders = headers
+	}
+}
+
+// NewHMACVerificationMiddleware verifies the HMAC-SHA256 signature of incoming requests
+// signed by `dhttp.NewHMACSigningRoundTripper`. The secret is resolved through `keyFunc`
+// from the request's key ID (empty if the client did not send one).
+//
+// The request is rejected with a derr `401 Unauthorized` error if the signature is missing
+// or invalid, if it does not cover the headers set through `HMACRequiredHeaders`, if the body does not match its signed digest, if the signature timestamp is
+// outside the allowed clock skew or if its nonce was already used. A body bigger than
+// `HMACMaxBodySize` is rejected with a derr `413 Request Entity Too Large` error.
+func NewHMACVerificationMiddleware(keyFunc func(keyID string) (secret []byte, found bool), opts ...HMACVerificationOption) mux.MiddlewareFunc {
+	verifier := &hmacVerifier{
+		keyFunc:         keyFunc,
+		maxClockSkew:    5 * time.Minute,
+		maxBodySize:     10 * 1024 * 1024,
+		requiredHeaders: dhttp.DefaultHMACSignedHeaders,
+		now:             time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(verifier)
+	}
+
+	if verifier.nonces == nil {
+		verifier.nonces = NewMemoryNonceStore()
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := verifier.verify(r); err != nil {
+				ctx := r.Context()
+
+				var errResponse *derr.ErrorResponse
+				if errors.As(err, &errResponse) {
+					dhttp.WriteError(ctx, w, errResponse)
+					return
+				}
+
+				dhttp.WriteError(ctx, w, derr.HTTPUnauthorizedError(ctx, err, derr.C("invalid_signature_error"), "The request signature is invalid."))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type hmacVerifier struct {
+	keyFunc         func(keyID string) ([]byte, bool)
+	maxClockSkew    time.Duration
+	maxBodySize     int64
+	requiredHeaders []string
+	nonces          NonceStore
+	now             func() time.Time
+}
+
+func (v *hmacVerifier) verify(r *http.Request) error {
+	signature := r.Header.Get(dhttp.HMACSignatureHeader)
+	timestamp := r.Header.Get(dhttp.HMACTimestampHeader)
+	nonce := r.Header.Get(dhttp.HMACNonceHeader)
+	digest := r.Header.Get(dhttp.HMACContentDigestHeader)
+	if signature == "" || timestamp == "" || nonce == "" || digest == "" {
+		return fmt.Errorf("missing signature headers")
+	}
+
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid signature timestamp %q", timestamp)
+	}
+
+	skew := v.now().Sub(time.Unix(signedAt, 0))
+	if skew > v.maxClockSkew || skew < -v.maxClockSkew {
+		return fmt.Errorf("signature timestamp is %s away from local clock", skew)
+	}
+
+	secret, found := v.keyFunc(r.Header.Get(dhttp.HMACKeyIDHeader))
+	if !found {
+		return fmt.Errorf("unknown signature key %q", r.Header.Get(dhttp.HMACKeyIDHeader))
+	}
+
+	body, err := v.readBody(r)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal([]byte(dhttp.ContentDigest(body)), []byte(strings.ToLower(digest))) {
+		return fmt.Errorf("body does not match its signed digest")
+	}
+
+	var signedHeaders []string
+	if value := r.Header.Get(dhttp.HMACSignedHeadersHeader); value != "" {
+		signedHeaders = strings.Split(value, ";")
+	}
+
+	if missing := missingHeader(v.requiredHeaders, signedHeaders); missing != "" {
+		return fmt.Errorf("header %q is not part of the signature", missing)
+	}
+
+	expected := dhttp.HMACSign(secret, dhttp.HMACStringToSign(r, signedHeaders, timestamp, nonce, digest))
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return fmt.Errorf("signature mismatch")
+	}
+
+	// Nonces are recorded only once the signature is known to be valid, a nonce must stay
+	// remembered for as long as its timestamp is accepted
+	if !v.nonces.CheckAndStore(nonce, time.Unix(signedAt, 0).Add(v.maxClockSkew)) {
+		return fmt.Errorf("nonce %q already used", nonce)
+	}
+
+	return nil
+}
+
+// missingHeader returns the first required header not listed in `signedHeaders`, if any.
+func missingHeader(required []string, signedHeaders []string) string {
+	for _, header := range required {
+		found := false
+		for _, signed := range signedHeaders {
+			if strings.EqualFold(strings.TrimSpace(signed), strings.TrimSpace(header)) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return header
+		}
+	}
+
+	return ""
+}
+
+// readBody reads the request's body and replaces it by an in-memory copy for the next handlers.
+func (v *hmacVerifier) readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+
+	if r.ContentLength > v.maxBodySize {
+		return nil, dhttp.RequestBodyTooLargeError(r.Context(), fmt.Errorf("content length %d exceeds limit", r.ContentLength), v.maxBodySize)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, v.maxBodySize+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read body: %w", err)
+	}
+
+	if int64(len(body)) > v.maxBodySize {
+		return nil, dhttp.RequestBodyTooLargeError(r.Context(), fmt.Errorf("body is bigger than %d bytes", v.maxBodySize), v.maxBodySize)
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
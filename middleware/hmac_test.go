@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/streamingfast/dhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHMACVerificationMiddleware(t *testing.T) {
+	secret := []byte("secret")
+	keyFunc := func(keyID string) ([]byte, bool) {
+		return secret, keyID == "key-1"
+	}
+
+	router := mux.NewRouter()
+	router.Use(NewHMACVerificationMiddleware(keyFunc, HMACMaxBodySize(16)))
+	router.Path("/echo").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	var lastSigned *http.Request
+	capture := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		lastSigned = r.Clone(r.Context())
+		return http.DefaultTransport.RoundTrip(r)
+	})
+
+	signing := dhttp.NewHMACSigningRoundTripper(secret, capture, dhttp.HMACKeyID("key-1"))
+
+	post := func(transport http.RoundTripper, body string) *http.Response {
+		request, _ := http.NewRequest("POST", server.URL+"/echo?a=b", strings.NewReader(body))
+		request.Header.Set("Content-Type", "text/plain")
+
+		response, err := transport.RoundTrip(request)
+		require.NoError(t, err)
+		return response
+	}
+
+	t.Run("valid signature", func(t *testing.T) {
+		response := post(signing, "hello")
+		defer response.Body.Close()
+
+		body, _ := io.ReadAll(response.Body)
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, "hello", string(body))
+	})
+
+	t.Run("replayed request", func(t *testing.T) {
+		response := post(signing, "hello")
+		response.Body.Close()
+
+		replayed := lastSigned.Clone(lastSigned.Context())
+		replayed.Body = io.NopCloser(strings.NewReader("hello"))
+
+		response, err := http.DefaultTransport.RoundTrip(replayed)
+		require.NoError(t, err)
+		response.Body.Close()
+
+		assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	})
+
+	t.Run("tampered body", func(t *testing.T) {
+		response := post(signing, "hello")
+		response.Body.Close()
+
+		tampered := lastSigned.Clone(lastSigned.Context())
+		tampered.Header.Set(dhttp.HMACNonceHeader, "other")
+		tampered.Body = io.NopCloser(strings.NewReader("tampered"))
+
+		response, err := http.DefaultTransport.RoundTrip(tampered)
+		require.NoError(t, err)
+		response.Body.Close()
+
+		assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	})
+
+	t.Run("required header not signed", func(t *testing.T) {
+		response := post(dhttp.NewHMACSigningRoundTripper(secret, nil, dhttp.HMACKeyID("key-1"), dhttp.HMACSignedHeaders("Host")), "hello")
+		response.Body.Close()
+
+		assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	})
+
+	t.Run("body too large", func(t *testing.T) {
+		response := post(signing, strings.Repeat("a", 17))
+		response.Body.Close()
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, response.StatusCode)
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		response := post(http.DefaultTransport, "hello")
+		response.Body.Close()
+
+		assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	})
+}
+
+func TestHMACVerifier_ClockSkew(t *testing.T) {
+	secret := []byte("secret")
+	signing := dhttp.NewHMACSigningRoundTripper(secret, roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		verifier := &hmacVerifier{
+			keyFunc:      func(string) ([]byte, bool) { return secret, true },
+			maxClockSkew: time.Minute,
+			maxBodySize:  1024,
+			nonces:       NewMemoryNonceStore(),
+			now:          func() time.Time { return time.Now().Add(2 * time.Minute) },
+		}
+
+		assert.ErrorContains(t, verifier.verify(r), "away from local clock")
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	}))
+
+	request, _ := http.NewRequest("GET", "http://upstream/", nil)
+	_, err := signing.RoundTrip(request)
+	require.NoError(t, err)
+}
+
+func TestHMACStringToSign_HeadersUnchanged(t *testing.T) {
+	request, _ := http.NewRequest("GET", "http://upstream/resource", nil)
+	request.Header["X-Custom"] = []string{"  a  ", " b"}
+
+	stringToSign := dhttp.HMACStringToSign(request, []string{"X-Custom"}, "1", "nonce", "digest")
+
+	assert.Equal(t, "GET\n/resource\n1\nnonce\nx-custom:a,b\ndigest", stringToSign)
+	assert.Equal(t, []string{"  a  ", " b"}, request.Header["X-Custom"])
+}
+
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
@@ -0,0 +1,7 @@
+package middleware
+
+import (
+	"github.com/streamingfast/logging"
+)
+
+var zlog, _ = logging.PackageLogger("dhttp/middleware", "github.com/streamingfast/dhttp/middleware")
@@ -0,0 +1,353 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/streamingfast/dhttp"
+	"github.com/streamingfast/logging"
+	sftracing "github.com/streamingfast/sf-tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+type MirrorOption func(m *mirror)
+
+// MirrorSampleRate sets the ratio (between 0 and 1) of requests mirrored to the shadow
+// upstream, defaults to 1 (all requests).
+func MirrorSampleRate(rate float64) MirrorOption {
+	return func(m *mirror) {
+		m.sampleRate = rate
+	}
+}
+
+// MirrorMaxBodySize sets the maximum size of a request body buffered to be mirrored,
+// requests with bigger bodies are not mirrored. Defaults to 1 MiB.
+func MirrorMaxBodySize(maxBodySize int64) MirrorOption {
+	return func(m *mirror) {
+		m.maxBodySize = maxBodySize
+	}
+}
+
+// MirrorCompareResponses enables the comparison of the shadow response against the
+// primary one, a mismatch of status code or body is logged at info level. Only the first
+// `maxBodySize` bytes of both bodies are compared.
+func MirrorCompareResponses(maxBodySize int64) MirrorOption {
+	return func(m *mirror) {
+		m.compare = true
+		m.maxCompareSize = maxBodySize
+	}
+}
+
+// MirrorTransport sets the `http.RoundTripper` used to reach the shadow upstream, defaults
+// to `http.DefaultTransport`.
+func MirrorTransport(transport http.RoundTripper) MirrorOption {
+	return func(m *mirror) {
+		m.transport = transport
+	}
+}
+
+// MirrorTimeout sets the timeout of shadow requests, defaults to 10 seconds.
+func MirrorTimeout(timeout time.Duration) MirrorOption {
+	return func(m *mirror) {
+		m.timeout = timeout
+	}
+}
+
+// MirrorMaxInFlight sets the maximum number of concurrent shadow requests, requests are
+// not mirrored while the limit is reached. Defaults to 100.
+func MirrorMaxInFlight(maxInFlight int) MirrorOption {
+	return func(m *mirror) {
+		m.maxInFlight = maxInFlight
+	}
+}
+
+// NewMirroringMiddleware sends a copy of sampled incoming requests to the `shadowURL`
+// upstream, the request path and query being appended to its own. Shadow requests are
+// performed asynchronously and their responses are discarded, the client only ever sees
+// the primary handler's response and never waits on the shadow upstream.
+//
+// Shadow requests carry the trace context of the incoming request, injected with the
+// globally registered propagator (`otel.GetTextMapPropagator()`), and failures, as well as
+// response mismatches when `MirrorCompareResponses` is used, are logged along the request's
+// `trace_id`. When comparing, the shadow request is still sent right away, the comparison
+// happening once both responses are available. Hijacked connections are not compared.
+func NewMirroringMiddleware(logger *zap.Logger, shadowURL string, opts ...MirrorOption) (mux.MiddlewareFunc, error) {
+	target, err := url.Parse(shadowURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid shadow URL %q: %w", shadowURL, err)
+	}
+
+	if target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("invalid shadow URL %q: scheme and host are required", shadowURL)
+	}
+
+	m := &mirror{
+		logger:      logger,
+		target:      target,
+		sampleRate:  1,
+		maxBodySize: 1024 * 1024,
+		transport:   http.DefaultTransport,
+		timeout:     10 * time.Second,
+		maxInFlight: 100,
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	m.inFlight = make(chan struct{}, m.maxInFlight)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			m.serveHTTP(next, w, r)
+		})
+	}, nil
+}
+
+type mirror struct {
+	logger         *zap.Logger
+	target         *url.URL
+	sampleRate     float64
+	maxBodySize    int64
+	compare        bool
+	maxCompareSize int64
+	transport      http.RoundTripper
+	timeout        time.Duration
+	maxInFlight    int
+
+	inFlight chan struct{}
+}
+
+// mirroredResponse is the primary response captured for comparison.
+type mirroredResponse struct {
+	status int
+	body   []byte
+}
+
+func (m *mirror) serveHTTP(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	if m.sampleRate < 1 && rand.Float64() >= m.sampleRate {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	body, ok := m.bufferBody(r)
+	if !ok {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	shadow, err := m.newShadowRequest(r, body)
+	if err != nil {
+		logging.Logger(r.Context(), m.logger).Info("unable to create shadow request, not mirroring request", zap.Error(err))
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		logging.Logger(r.Context(), m.logger).Debug("too many shadow requests in flight, not mirroring request")
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	traceID := sftracing.GetTraceID(r.Context())
+
+	if !m.compare {
+		go m.send(shadow, traceID, nil)
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	// Closed without a value if the handler panics, the comparison is skipped then
+	primary := make(chan *mirroredResponse, 1)
+	defer close(primary)
+
+	go m.send(shadow, traceID, primary)
+
+	recorder := &recordingResponseWriter{ResponseWriter: w, maxBodySize: m.maxCompareSize}
+	next.ServeHTTP(recorder, r)
+
+	if !recorder.hijacked {
+		primary <- &mirroredResponse{status: recorder.statusCode(), body: recorder.body.Bytes()}
+	}
+}
+
+// bufferBody reads the request's body in memory, replacing it with an in-memory copy. It
+// returns `false` if the body is too big to be mirrored, in which case the request's body
+// is restored as is.
+func (m *mirror) bufferBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+
+	if r.ContentLength > m.maxBodySize {
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, m.maxBodySize+1))
+	if err != nil || int64(len(body)) > m.maxBodySize {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+func (m *mirror) newShadowRequest(r *http.Request, body []byte) (*http.Request, error) {
+	// The shadow request must outlive the incoming one, only the trace context and the
+	// logger are kept
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(r.Context()))
+	ctx = logging.WithLogger(ctx, logging.Logger(r.Context(), m.logger))
+
+	shadowURL := *m.target
+	shadowURL.Path = strings.TrimSuffix(m.target.Path, "/") + r.URL.Path
+	shadowURL.RawPath = ""
+	shadowURL.RawQuery = r.URL.RawQuery
+
+	shadow, err := http.NewRequestWithContext(ctx, r.Method, shadowURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid shadow request: %w", err)
+	}
+
+	if body == nil {
+		shadow.Body = http.NoBody
+	}
+
+	shadow.Header = r.Header.Clone()
+	dhttp.RemoveHopByHopHeaders(shadow.Header)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(shadow.Header))
+
+	return shadow, nil
+}
+
+// send performs the shadow request, comparing its response with the primary one received
+// on `primaryResponses` when comparing is enabled.
+func (m *mirror) send(shadow *http.Request, traceID trace.TraceID, primaryResponses <-chan *mirroredResponse) {
+	defer func() { <-m.inFlight }()
+
+	ctx, cancel := context.WithTimeout(shadow.Context(), m.timeout)
+	defer cancel()
+
+	logger := logging.Logger(ctx, m.logger).With(
+		zap.Stringer("trace_id", traceID),
+		zap.String("method", shadow.Method),
+		zap.String("path", shadow.URL.Path),
+	)
+
+	response, err := m.transport.RoundTrip(shadow.WithContext(ctx))
+	if err != nil {
+		logger.Info("shadow request failed", zap.Error(err))
+		return
+	}
+	defer response.Body.Close()
+
+	if primaryResponses == nil {
+		io.Copy(io.Discard, response.Body)
+		return
+	}
+
+	shadowBody, err := io.ReadAll(io.LimitReader(response.Body, m.maxCompareSize))
+	if err != nil {
+		logger.Info("unable to read shadow response body", zap.Error(err))
+		return
+	}
+
+	primary := <-primaryResponses
+	if primary == nil {
+		return
+	}
+
+	statusMismatch := primary.status != response.StatusCode
+	bodyMismatch := !bytes.Equal(primary.body, shadowBody)
+	if statusMismatch || bodyMismatch {
+		logger.Info("shadow response does not match primary response",
+			zap.Int("primary_status", primary.status),
+			zap.Int("shadow_status", response.StatusCode),
+			zap.Bool("body_mismatch", bodyMismatch),
+			zap.Int("primary_body_size", len(primary.body)),
+			zap.Int("shadow_body_size", len(shadowBody)),
+		)
+	}
+}
+
+// recordingResponseWriter captures the status code and the first bytes of the body
+// written through it.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+
+	status      int
+	body        bytes.Buffer
+	maxBodySize int64
+	hijacked    bool
+}
+
+func (w *recordingResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *recordingResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	if remaining := w.maxBodySize - int64(w.body.Len()); remaining > 0 {
+		if int64(len(p)) < remaining {
+			w.body.Write(p)
+		} else {
+			w.body.Write(p[:remaining])
+		}
+	}
+
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *recordingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *recordingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+
+	conn, buffered, err := hijacker.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+
+	return conn, buffered, err
+}
+
+func (w *recordingResponseWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+
+	return w.status
+}
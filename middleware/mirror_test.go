@@ -0,0 +1,193 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestMirroringMiddleware(t *testing.T) {
+	type shadowCall struct {
+		path string
+		body string
+	}
+
+	shadowCalls := make(chan shadowCall, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		shadowCalls <- shadowCall{r.URL.RequestURI(), string(body)}
+
+		if r.URL.Path == "/v1/different" {
+			w.WriteHeader(http.StatusTeapot)
+		}
+		w.Write(body)
+	}))
+	defer shadow.Close()
+
+	core, logs := observer.New(zap.DebugLevel)
+	mirroring, err := NewMirroringMiddleware(zap.New(core), shadow.URL+"/v1", MirrorCompareResponses(1024), MirrorMaxBodySize(16))
+	require.NoError(t, err)
+
+	router := mux.NewRouter()
+	router.Use(mirroring)
+	router.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+
+	t.Run("mirrored and matching", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("POST", "/same?q=1", strings.NewReader("payload")))
+
+		assert.Equal(t, "payload", recorder.Body.String())
+		assert.Equal(t, shadowCall{"/v1/same?q=1", "payload"}, receive(t, shadowCalls))
+	})
+
+	t.Run("mirrored and different", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("POST", "/different", strings.NewReader("payload")))
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		receive(t, shadowCalls)
+
+		require.Eventually(t, func() bool {
+			return logs.FilterMessage("shadow response does not match primary response").Len() == 1
+		}, time.Second, 5*time.Millisecond)
+
+		entry := logs.FilterMessage("shadow response does not match primary response").All()[0]
+		assert.Equal(t, int64(http.StatusOK), entry.ContextMap()["primary_status"])
+		assert.Equal(t, int64(http.StatusTeapot), entry.ContextMap()["shadow_status"])
+		assert.Contains(t, entry.ContextMap(), "trace_id")
+	})
+
+	t.Run("invalid shadow request", func(t *testing.T) {
+		request := httptest.NewRequest("GET", "/invalid", nil)
+		request.Method = "BAD METHOD"
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, 1, logs.FilterMessage("unable to create shadow request, not mirroring request").Len())
+	})
+
+	t.Run("body too large", func(t *testing.T) {
+		// Hides the body length so the body is read past the limit and restored
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("POST", "/large", io.MultiReader(strings.NewReader(strings.Repeat("a", 20)))))
+
+		assert.Equal(t, strings.Repeat("a", 20), recorder.Body.String())
+
+		select {
+		case call := <-shadowCalls:
+			t.Fatalf("unexpected shadow call %v", call)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
+
+func TestMirroringMiddleware_Compare(t *testing.T) {
+	traceParents := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceParents <- r.Header.Get("traceparent")
+		w.Write([]byte("shadow"))
+	}))
+	defer shadow.Close()
+
+	mirroring, err := NewMirroringMiddleware(zap.NewNop(), shadow.URL, MirrorCompareResponses(1024))
+	require.NoError(t, err)
+
+	router := mux.NewRouter()
+	router.Use(mirroring)
+	router.Path("/concurrent").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The shadow request must not wait on the primary handler
+		receive(t, traceParents)
+		w.Write([]byte("primary"))
+	})
+	router.Path("/hijack").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hijacker, ok := w.(http.Hijacker)
+		require.True(t, ok)
+
+		conn, buffered, err := hijacker.Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		buffered.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		buffered.Flush()
+	})
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	get := func(t *testing.T, path string, header http.Header) string {
+		request, err := http.NewRequest("GET", server.URL+path, nil)
+		require.NoError(t, err)
+		request.Header = header
+
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+
+		body, err := io.ReadAll(response.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	t.Run("shadow request sent concurrently", func(t *testing.T) {
+		assert.Equal(t, "primary", get(t, "/concurrent", http.Header{}))
+	})
+
+	t.Run("hijacked", func(t *testing.T) {
+		assert.Equal(t, "hijacked", get(t, "/hijack", http.Header{}))
+		receive(t, traceParents)
+	})
+}
+
+func TestMirroringMiddleware_TraceContext(t *testing.T) {
+	traceParents := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceParents <- r.Header.Get("traceparent")
+	}))
+	defer shadow.Close()
+
+	mirroring, err := NewMirroringMiddleware(zap.NewNop(), shadow.URL)
+	require.NoError(t, err)
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	handler := mirroring(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", receive(t, traceParents))
+}
+
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+
+	select {
+	case value := <-ch:
+		return value
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for value")
+	}
+
+	var zero T
+	return zero
+}
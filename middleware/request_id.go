@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/streamingfast/logging"
+	sftracing "github.com/streamingfast/sf-tracing"
+	"go.uber.org/zap"
+)
+
+const (
+	// RequestIDHeader is the default header carrying the request ID, in both directions.
+	RequestIDHeader = "X-Request-Id"
+
+	// TraceIDHeader is the response header carrying the request's trace ID.
+	TraceIDHeader = "X-Trace-Id"
+)
+
+type requestIDKey struct{}
+
+// RequestIDFromContext returns the request ID set by `NewRequestIDMiddleware`, empty if
+// the middleware did not run.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+type RequestIDOption func(m *requestIDMiddleware)
+
+// RequestIDHeaderName sets the header the request ID is read from and echoed in, defaults
+// to `X-Request-Id`.
+func RequestIDHeaderName(name string) RequestIDOption {
+	return func(m *requestIDMiddleware) {
+		m.header = name
+	}
+}
+
+// RequestIDMaxLength sets the maximum length of an incoming request ID, longer ones are
+// replaced by a generated ID. Defaults to 128.
+func RequestIDMaxLength(maxLength int) RequestIDOption {
+	return func(m *requestIDMiddleware) {
+		m.maxLength = maxLength
+	}
+}
+
+// RequestIDGenerator sets the function generating request IDs for requests without a
+// valid one, defaults to 32 random hexadecimal characters.
+func RequestIDGenerator(generator func() string) RequestIDOption {
+	return func(m *requestIDMiddleware) {
+		m.generator = generator
+	}
+}
+
+// NewRequestIDMiddleware assigns an ID to each request, the one received in the
+// `X-Request-Id` header if valid, otherwise a generated one. An incoming ID is valid if it
+// is not too long and only contains ASCII letters, digits, `-`, `_`, `.` and `:`.
+//
+// The ID is stored in the request's context, retrieve it with `RequestIDFromContext`, and
+// is added as the `request_id` field of the request specific logger, install it after
+// `NewTracingLoggingMiddleware` to have it alongside the `trace_id` field. Both IDs are
+// echoed in the `X-Request-Id` and `X-Trace-Id` response headers so clients can quote them.
+func NewRequestIDMiddleware(logger *zap.Logger, opts ...RequestIDOption) mux.MiddlewareFunc {
+	m := &requestIDMiddleware{
+		logger:    logger,
+		header:    RequestIDHeader,
+		maxLength: 128,
+		generator: newRequestID,
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+
+			id := r.Header.Get(m.header)
+			if !m.isValid(id) {
+				id = m.generator()
+			}
+
+			ctx = context.WithValue(ctx, requestIDKey{}, id)
+			ctx = logging.WithLogger(ctx, logging.Logger(ctx, m.logger).With(zap.String("request_id", id)))
+
+			w.Header().Set(m.header, id)
+			if traceID := sftracing.GetTraceID(ctx); traceID.IsValid() {
+				w.Header().Set(TraceIDHeader, traceID.String())
+			}
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+type requestIDMiddleware struct {
+	logger    *zap.Logger
+	header    string
+	maxLength int
+	generator func() string
+}
+
+func (m *requestIDMiddleware) isValid(id string) bool {
+	if id == "" || len(id) > m.maxLength {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(id)
+}
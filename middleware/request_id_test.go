@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/streamingfast/logging"
+	sftracing "github.com/streamingfast/sf-tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+
+	var seenID string
+	router := mux.NewRouter()
+	router.Use(NewRequestIDMiddleware(zap.New(core), RequestIDGenerator(func() string { return "generated" })))
+	router.Path("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenID = RequestIDFromContext(r.Context())
+		logging.Logger(r.Context(), zap.NewNop()).Info("handled")
+	})
+
+	tests := []struct {
+		name     string
+		incoming string
+		expected string
+	}{
+		{"valid incoming", "abc-123_def.4:5", "abc-123_def.4:5"},
+		{"missing", "", "generated"},
+		{"invalid charset", "abc\ninjected", "generated"},
+		{"too long", strings.Repeat("a", 129), "generated"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logs.TakeAll()
+
+			request := httptest.NewRequest("GET", "/", nil)
+			request = request.WithContext(sftracing.NewFixedTraceIDInContext(request.Context(), "00000000000000000000000000000001"))
+			if test.incoming != "" {
+				request.Header.Set(RequestIDHeader, test.incoming)
+			}
+
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+
+			assert.Equal(t, test.expected, seenID)
+			assert.Equal(t, test.expected, recorder.Header().Get(RequestIDHeader))
+			assert.Equal(t, "00000000000000000000000000000001", recorder.Header().Get(TraceIDHeader))
+
+			entries := logs.TakeAll()
+			require.Len(t, entries, 1)
+			assert.Equal(t, test.expected, entries[0].ContextMap()["request_id"])
+		})
+	}
+}
+
+func Test_newRequestID(t *testing.T) {
+	id := newRequestID()
+
+	assert.Len(t, id, 32)
+	assert.NotEqual(t, id, newRequestID())
+}
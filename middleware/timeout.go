@@ -0,0 +1,302 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/streamingfast/derr"
+	"github.com/streamingfast/dhttp"
+	"github.com/streamingfast/logging"
+	"go.uber.org/zap"
+)
+
+// RequestTimeoutErrorCode is the `derr.ErrorCode` of the error answered by the middleware
+// created with `NewTimeoutMiddleware` when a handler did not respond in time.
+const RequestTimeoutErrorCode derr.ErrorCode = "request_timeout_error"
+
+// RequestTimeoutHeader is the default header through which clients can shorten the
+// timeout of their request.
+const RequestTimeoutHeader = "Request-Timeout"
+
+type TimeoutOption func(m *timeoutMiddleware)
+
+// TimeoutRoute overrides the timeout for the `mux` route named `name`.
+func TimeoutRoute(name string, timeout time.Duration) TimeoutOption {
+	return func(m *timeoutMiddleware) {
+		m.routes[name] = timeout
+	}
+}
+
+// TimeoutStatusCode sets the status code of the timeout error, either
+// `http.StatusServiceUnavailable` (the default) or `http.StatusGatewayTimeout`.
+func TimeoutStatusCode(statusCode int) TimeoutOption {
+	return func(m *timeoutMiddleware) {
+		m.statusCode = statusCode
+	}
+}
+
+// TimeoutClientHeader sets the header through which clients can request a timeout, as a
+// number of seconds (`1.5`) or a Go duration (`1500ms`). The requested timeout is capped
+// at `maxTimeout`, defaults to the `Request-Timeout` header capped at the route's timeout,
+// so clients can only shorten it. An empty header name disables it.
+func TimeoutClientHeader(header string, maxTimeout time.Duration) TimeoutOption {
+	return func(m *timeoutMiddleware) {
+		m.clientHeader = header
+		m.maxClientTimeout = maxTimeout
+	}
+}
+
+// NewTimeoutMiddleware bounds the time handlers have to respond, by default `timeout`.
+// The deadline is applied to the request's context and if the handler did not start
+// writing its response by then, a derr `503 Service Unavailable` error is answered in its
+// place. Writes performed by the handler afterwards are discarded and fail with
+// `http.ErrHandlerTimeout`.
+//
+// A handler that started writing its response, or hijacked the connection, before the
+// deadline is left to complete it, it's up to it to stop once the request's context is done.
+func NewTimeoutMiddleware(logger *zap.Logger, timeout time.Duration, opts ...TimeoutOption) mux.MiddlewareFunc {
+	m := &timeoutMiddleware{
+		logger:       logger,
+		timeout:      timeout,
+		routes:       map[string]time.Duration{},
+		statusCode:   http.StatusServiceUnavailable,
+		clientHeader: RequestTimeoutHeader,
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			m.serveHTTP(next, w, r)
+		})
+	}
+}
+
+type timeoutMiddleware struct {
+	logger           *zap.Logger
+	timeout          time.Duration
+	routes           map[string]time.Duration
+	statusCode       int
+	clientHeader     string
+	maxClientTimeout time.Duration
+}
+
+func (m *timeoutMiddleware) serveHTTP(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	timeout := m.requestTimeout(r)
+	if timeout <= 0 {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	tw := &timeoutResponseWriter{w: w, header: make(http.Header)}
+
+	done := make(chan struct{})
+	panicked := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				panicked <- p
+			}
+		}()
+
+		next.ServeHTTP(tw, r.WithContext(ctx))
+		close(done)
+	}()
+
+	select {
+	case p := <-panicked:
+		panic(p)
+
+	case <-done:
+		return
+
+	case <-ctx.Done():
+		if !tw.timeout() {
+			// The handler already started its response, it's the only one who can complete it
+			select {
+			case p := <-panicked:
+				panic(p)
+			case <-done:
+			}
+			return
+		}
+
+		if r.Context().Err() != nil {
+			// The client went away, there is nobody to answer to
+			return
+		}
+
+		logging.Logger(ctx, m.logger).Info("handler did not respond in time", zap.Duration("timeout", timeout))
+
+		err := fmt.Errorf("handler did not respond within %s", timeout)
+		dhttp.WriteError(ctx, w, derr.HTTPErrorFromStatus(m.statusCode, ctx, err, RequestTimeoutErrorCode, "The request did not complete in time."))
+	}
+}
+
+func (m *timeoutMiddleware) requestTimeout(r *http.Request) time.Duration {
+	timeout := m.timeout
+	if route := mux.CurrentRoute(r); route != nil {
+		if routeTimeout, found := m.routes[route.GetName()]; found {
+			timeout = routeTimeout
+		}
+	}
+
+	if m.clientHeader == "" {
+		return timeout
+	}
+
+	clientTimeout, ok := parseClientTimeout(r.Header.Get(m.clientHeader))
+	if !ok || clientTimeout <= 0 {
+		return timeout
+	}
+
+	maxTimeout := m.maxClientTimeout
+	if maxTimeout <= 0 {
+		maxTimeout = timeout
+	}
+
+	if maxTimeout > 0 && clientTimeout > maxTimeout {
+		return maxTimeout
+	}
+
+	return clientTimeout
+}
+
+func parseClientTimeout(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		if math.IsNaN(seconds) || math.IsInf(seconds, 0) || seconds <= 0 {
+			return 0, false
+		}
+
+		// Converting would overflow to a negative duration, the value is capped by the caller anyway
+		if seconds >= float64(math.MaxInt64)/float64(time.Second) {
+			return time.Duration(math.MaxInt64), true
+		}
+
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, false
+	}
+
+	return duration, true
+}
+
+// timeoutResponseWriter buffers the handler's headers until it writes its status and
+// drops everything once the middleware answered in its place.
+type timeoutResponseWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+
+	lock        sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutResponseWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutResponseWriter) WriteHeader(statusCode int) {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+
+	tw.writeHeader(statusCode)
+}
+
+func (tw *timeoutResponseWriter) writeHeader(statusCode int) {
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+
+	tw.wroteHeader = true
+
+	dst := tw.w.Header()
+	for name, values := range tw.header {
+		dst[name] = values
+	}
+
+	tw.w.WriteHeader(statusCode)
+}
+
+func (tw *timeoutResponseWriter) Write(p []byte) (int, error) {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+
+	tw.writeHeader(http.StatusOK)
+	return tw.w.Write(p)
+}
+
+func (tw *timeoutResponseWriter) Flush() {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+
+	if tw.timedOut {
+		return
+	}
+
+	if flusher, ok := tw.w.(http.Flusher); ok {
+		tw.writeHeader(http.StatusOK)
+		flusher.Flush()
+	}
+}
+
+// Hijack hands the connection over to the handler, the middleware does not answer in its
+// place past this point.
+func (tw *timeoutResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+
+	if tw.timedOut {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+
+	hijacker, ok := tw.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+
+	conn, buffered, err := hijacker.Hijack()
+	if err == nil {
+		tw.wroteHeader = true
+	}
+
+	return conn, buffered, err
+}
+
+// timeout marks the response as timed out, returning `false` if the handler already
+// started writing its response.
+func (tw *timeoutResponseWriter) timeout() bool {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+
+	if tw.wroteHeader {
+		return false
+	}
+
+	tw.timedOut = true
+	return true
+}
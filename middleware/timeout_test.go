@@ -0,0 +1,148 @@
+package middleware
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestTimeoutMiddleware(t *testing.T) {
+	lateWrite := make(chan error, 1)
+
+	router := mux.NewRouter()
+	router.Use(NewTimeoutMiddleware(zap.NewNop(), 50*time.Millisecond, TimeoutRoute("fast", 10*time.Millisecond)))
+
+	sleeping := func(w http.ResponseWriter, r *http.Request) {
+		delay, _ := time.ParseDuration(r.URL.Query().Get("delay"))
+		select {
+		case <-time.After(delay):
+			w.Write([]byte("done"))
+		case <-r.Context().Done():
+			// Leaves time for the middleware to answer before writing
+			time.Sleep(20 * time.Millisecond)
+
+			w.Header().Set("X-Late", "true")
+			_, err := w.Write([]byte("late"))
+			lateWrite <- err
+		}
+	}
+
+	router.Path("/").HandlerFunc(sleeping)
+	router.Path("/fast").Name("fast").HandlerFunc(sleeping)
+	router.Path("/streaming").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("started"))
+		<-r.Context().Done()
+		w.Write([]byte(" then stopped"))
+	})
+
+	tests := []struct {
+		name         string
+		path         string
+		header       http.Header
+		expectedCode int
+		expectedBody string
+	}{
+		{"in time", "/?delay=1ms", nil, http.StatusOK, "done"},
+		{"timed out", "/?delay=1s", nil, http.StatusServiceUnavailable, "request_timeout_error"},
+		{"route timeout", "/fast?delay=30ms", nil, http.StatusServiceUnavailable, "request_timeout_error"},
+		{"client timeout", "/?delay=30ms", http.Header{"Request-Timeout": []string{"0.01"}}, http.StatusServiceUnavailable, "request_timeout_error"},
+		{"client timeout capped", "/?delay=200ms", http.Header{"Request-Timeout": []string{"10s"}}, http.StatusServiceUnavailable, "request_timeout_error"},
+		{"overflowing client timeout", "/?delay=1s", http.Header{"Request-Timeout": []string{"1e300"}}, http.StatusServiceUnavailable, "request_timeout_error"},
+		{"invalid client timeout", "/?delay=1ms", http.Header{"Request-Timeout": []string{"soon"}}, http.StatusOK, "done"},
+		{"started response", "/streaming", nil, http.StatusOK, "started then stopped"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", test.path, nil)
+			if test.header != nil {
+				request.Header = test.header
+			}
+
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+
+			assert.Equal(t, test.expectedCode, recorder.Code)
+			assert.Contains(t, recorder.Body.String(), test.expectedBody)
+
+			if test.expectedCode == http.StatusServiceUnavailable {
+				assert.Equal(t, http.ErrHandlerTimeout, <-lateWrite)
+				assert.Empty(t, recorder.Header().Get("X-Late"))
+			}
+		})
+	}
+}
+
+func TestTimeoutMiddleware_GatewayTimeout(t *testing.T) {
+	handler := NewTimeoutMiddleware(zap.NewNop(), 10*time.Millisecond, TimeoutStatusCode(http.StatusGatewayTimeout))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, http.StatusGatewayTimeout, recorder.Code)
+}
+
+func Test_parseClientTimeout(t *testing.T) {
+	tests := []struct {
+		input      string
+		expected   time.Duration
+		expectedOk bool
+	}{
+		{"", 0, false},
+		{"2", 2 * time.Second, true},
+		{"1.5", 1500 * time.Millisecond, true},
+		{"250ms", 250 * time.Millisecond, true},
+		{"0", 0, false},
+		{"-1s", 0, false},
+		{"soon", 0, false},
+		{"1e300", time.Duration(math.MaxInt64), true},
+		{"10000000000", time.Duration(math.MaxInt64), true},
+		{"NaN", 0, false},
+		{"+Inf", 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			timeout, ok := parseClientTimeout(test.input)
+			assert.Equal(t, test.expectedOk, ok)
+			assert.Equal(t, test.expected, timeout)
+		})
+	}
+}
+
+func TestTimeoutMiddleware_Hijack(t *testing.T) {
+	handler := NewTimeoutMiddleware(zap.NewNop(), 10*time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buffered, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		// The deadline passes while the handler owns the connection
+		<-r.Context().Done()
+
+		buffered.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		buffered.Flush()
+	}))
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "hijacked", string(body))
+}
@@ -0,0 +1,13 @@
+package proxy
+
+import (
+	"io"
+	"log"
+
+	"github.com/streamingfast/logging"
+)
+
+var zlog, _ = logging.PackageLogger("dhttp/proxy", "github.com/streamingfast/dhttp/proxy")
+
+// nopLogger discards the logs of `httputil.ReverseProxy`, failures are logged through `zlog`
+var nopLogger = log.New(io.Discard, "", 0)
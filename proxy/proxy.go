@@ -0,0 +1,396 @@
+// Package proxy implements a configurable HTTP reverse proxy following dhttp conventions:
+// errors are reported as derr JSON responses and logging goes through the request
+// specific logger.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/streamingfast/derr"
+	"github.com/streamingfast/dhttp"
+	"github.com/streamingfast/logging"
+	"go.uber.org/zap"
+)
+
+const (
+	// RouteNotFoundErrorCode is the `derr.ErrorCode` of the error returned when no route
+	// matches the request's path.
+	RouteNotFoundErrorCode derr.ErrorCode = "route_not_found_error"
+
+	// UpstreamUnavailableErrorCode is the `derr.ErrorCode` of the `502 Bad Gateway` error
+	// returned when the upstream could not be reached or its response could not be processed.
+	UpstreamUnavailableErrorCode derr.ErrorCode = "upstream_unavailable_error"
+
+	// UpstreamTimeoutErrorCode is the `derr.ErrorCode` of the `504 Gateway Timeout` error
+	// returned when the upstream did not respond in time.
+	UpstreamTimeoutErrorCode derr.ErrorCode = "upstream_timeout_error"
+)
+
+// RequestRewriter modifies the outgoing request before it is sent upstream, its URL
+// already targets the upstream.
+type RequestRewriter func(r *http.Request)
+
+// ResponseRewriter modifies the upstream response before it is forwarded to the client,
+// returning an error answers the client with a `502 Bad Gateway` error instead.
+type ResponseRewriter func(r *http.Response) error
+
+type Option func(p *ReverseProxy)
+
+// Route forwards requests whose path is `prefix` or starts with `prefix/` to `upstream`,
+// the most specific prefix wins when several routes match.
+func Route(prefix string, upstream string, opts ...RouteOption) Option {
+	return func(p *ReverseProxy) {
+		target, err := url.Parse(upstream)
+		if err != nil {
+			p.configErr = fmt.Errorf("invalid upstream %q for route %q: %w", upstream, prefix, err)
+			return
+		}
+
+		if target.Scheme == "" || target.Host == "" {
+			p.configErr = fmt.Errorf("invalid upstream %q for route %q: scheme and host are required", upstream, prefix)
+			return
+		}
+
+		r := &route{prefix: strings.TrimSuffix(prefix, "/"), upstream: target}
+		for _, opt := range opts {
+			opt(r)
+		}
+
+		p.routes = append(p.routes, r)
+	}
+}
+
+// Transport sets the `http.RoundTripper` used to reach upstreams of routes without their
+// own transport, defaults to `http.DefaultTransport`. It can be any dhttp round tripper
+// like `dhttp.NewLoggingRoundTripper`.
+func Transport(transport http.RoundTripper) Option {
+	return func(p *ReverseProxy) {
+		p.transport = transport
+	}
+}
+
+// RewriteRequest adds a hook invoked on every outgoing request, before route specific hooks.
+func RewriteRequest(rewriter RequestRewriter) Option {
+	return func(p *ReverseProxy) {
+		p.requestRewriters = append(p.requestRewriters, rewriter)
+	}
+}
+
+// RewriteResponse adds a hook invoked on every upstream response, after route specific hooks.
+func RewriteResponse(rewriter ResponseRewriter) Option {
+	return func(p *ReverseProxy) {
+		p.responseRewriters = append(p.responseRewriters, rewriter)
+	}
+}
+
+// TrustForwardedHeaders keeps the `Forwarded` and `X-Forwarded-*` headers received from
+// the client and appends to them. By default they are discarded since anybody can forge
+// them, enable it only when the proxy itself sits behind a trusted proxy.
+func TrustForwardedHeaders() Option {
+	return func(p *ReverseProxy) {
+		p.trustForwarded = true
+	}
+}
+
+// Logger sets the logger used to log upstream failures, the request specific logger is
+// used if one exists in the request's context.
+func Logger(logger *zap.Logger) Option {
+	return func(p *ReverseProxy) {
+		p.logger = logger
+	}
+}
+
+type RouteOption func(r *route)
+
+// StripPrefix removes the route's prefix from the request path before appending it
+// to the upstream's path.
+func StripPrefix() RouteOption {
+	return func(r *route) {
+		r.stripPrefix = true
+	}
+}
+
+// RouteTransport sets the `http.RoundTripper` used to reach this route's upstream.
+func RouteTransport(transport http.RoundTripper) RouteOption {
+	return func(r *route) {
+		r.transport = transport
+	}
+}
+
+// RouteRewriteRequest adds a hook invoked on outgoing requests of this route.
+func RouteRewriteRequest(rewriter RequestRewriter) RouteOption {
+	return func(r *route) {
+		r.requestRewriters = append(r.requestRewriters, rewriter)
+	}
+}
+
+// RouteRewriteResponse adds a hook invoked on upstream responses of this route.
+func RouteRewriteResponse(rewriter ResponseRewriter) RouteOption {
+	return func(r *route) {
+		r.responseRewriters = append(r.responseRewriters, rewriter)
+	}
+}
+
+type route struct {
+	prefix            string
+	upstream          *url.URL
+	stripPrefix       bool
+	transport         http.RoundTripper
+	requestRewriters  []RequestRewriter
+	responseRewriters []ResponseRewriter
+
+	handler *httputil.ReverseProxy
+}
+
+func (r *route) matches(path string) bool {
+	return path == r.prefix || strings.HasPrefix(path, r.prefix+"/") || r.prefix == ""
+}
+
+// ReverseProxy is an `http.Handler` forwarding requests to upstreams selected by path
+// prefix.
+type ReverseProxy struct {
+	routes            []*route
+	transport         http.RoundTripper
+	requestRewriters  []RequestRewriter
+	responseRewriters []ResponseRewriter
+	trustForwarded    bool
+	logger            *zap.Logger
+
+	configErr error
+}
+
+// NewReverseProxy creates a reverse proxy forwarding requests to the upstreams configured
+// through `Route` options. Requests matching no route are answered with a derr
+// `404 Not Found` error.
+//
+// Outgoing requests carry `X-Forwarded-For`, `X-Forwarded-Host`, `X-Forwarded-Proto` and
+// `Forwarded` (RFC 7239) headers describing the client, hop-by-hop headers are removed
+// in both directions and connection upgrades (WebSocket) are passed through. Upstream
+// failures are answered with a derr `504 Gateway Timeout` error for timeouts and a derr
+// `502 Bad Gateway` error otherwise.
+//
+// The proxy does not install any tracing or logging middleware, wrap it with
+// `middleware.NewTracingLoggingMiddleware` and use `dhttp.NewTracingRoundTripper` as the
+// transport to get both.
+func NewReverseProxy(opts ...Option) (*ReverseProxy, error) {
+	p := &ReverseProxy{
+		transport: http.DefaultTransport,
+		logger:    zlog,
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if p.configErr != nil {
+		return nil, p.configErr
+	}
+
+	if len(p.routes) == 0 {
+		return nil, fmt.Errorf("at least one route is required")
+	}
+
+	// Most specific prefixes first so the first matching route is the right one
+	sort.SliceStable(p.routes, func(i, j int) bool {
+		return len(p.routes[i].prefix) > len(p.routes[j].prefix)
+	})
+
+	for _, r := range p.routes {
+		r.handler = p.newHandler(r)
+	}
+
+	return p, nil
+}
+
+func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, candidate := range p.routes {
+		if candidate.matches(r.URL.Path) {
+			candidate.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	dhttp.WriteError(ctx, w, derr.HTTPNotFoundError(ctx, nil, RouteNotFoundErrorCode, "No route matches the requested path.", "path", r.URL.Path))
+}
+
+func (p *ReverseProxy) newHandler(r *route) *httputil.ReverseProxy {
+	transport := r.transport
+	if transport == nil {
+		transport = p.transport
+	}
+
+	return &httputil.ReverseProxy{
+		Transport: transport,
+		Director: func(out *http.Request) {
+			p.direct(r, out)
+		},
+		ModifyResponse: func(response *http.Response) error {
+			for _, rewriter := range r.responseRewriters {
+				if err := rewriter(response); err != nil {
+					return err
+				}
+			}
+
+			for _, rewriter := range p.responseRewriters {
+				if err := rewriter(response); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			p.handleError(r, w, req, err)
+		},
+		// Silences `httputil.ReverseProxy` own logging, errors are reported through `ErrorHandler`
+		ErrorLog: nopLogger,
+	}
+}
+
+func (p *ReverseProxy) direct(r *route, out *http.Request) {
+	path := out.URL.Path
+	rawPath := out.URL.RawPath
+	if r.stripPrefix {
+		path = strings.TrimPrefix(path, r.prefix)
+		rawPath = strings.TrimPrefix(rawPath, r.prefix)
+	}
+
+	out.URL.Scheme = r.upstream.Scheme
+	out.URL.Host = r.upstream.Host
+	out.URL.Path = joinPath(r.upstream.Path, path)
+	if rawPath != "" {
+		out.URL.RawPath = joinPath(r.upstream.EscapedPath(), rawPath)
+	}
+
+	if r.upstream.RawQuery != "" {
+		if out.URL.RawQuery == "" {
+			out.URL.RawQuery = r.upstream.RawQuery
+		} else {
+			out.URL.RawQuery = r.upstream.RawQuery + "&" + out.URL.RawQuery
+		}
+	}
+
+	p.setForwardedHeaders(out)
+
+	// Upstream sees its own host, the original one is in `X-Forwarded-Host`
+	out.Host = ""
+
+	if _, found := out.Header["User-Agent"]; !found {
+		// Prevents the default Go user agent from being added
+		out.Header.Set("User-Agent", "")
+	}
+
+	for _, rewriter := range p.requestRewriters {
+		rewriter(out)
+	}
+
+	for _, rewriter := range r.requestRewriters {
+		rewriter(out)
+	}
+}
+
+// setForwardedHeaders sets the `Forwarded` and `X-Forwarded-*` headers, `X-Forwarded-For`
+// is appended by `httputil.ReverseProxy` itself to what is left in the request.
+func (p *ReverseProxy) setForwardedHeaders(out *http.Request) {
+	if !p.trustForwarded {
+		out.Header.Del("Forwarded")
+		out.Header.Del("X-Forwarded-For")
+		out.Header.Del("X-Forwarded-Host")
+		out.Header.Del("X-Forwarded-Proto")
+	}
+
+	proto := "http"
+	if out.TLS != nil {
+		proto = "https"
+	}
+
+	if out.Header.Get("X-Forwarded-Host") == "" {
+		out.Header.Set("X-Forwarded-Host", out.Host)
+	}
+
+	if out.Header.Get("X-Forwarded-Proto") == "" {
+		out.Header.Set("X-Forwarded-Proto", proto)
+	}
+
+	element := fmt.Sprintf("host=%s;proto=%s", quoteForwardedValue(out.Host), proto)
+	if clientIP, _, err := net.SplitHostPort(out.RemoteAddr); err == nil {
+		element = "for=" + forwardedNode(clientIP) + ";" + element
+	}
+
+	if prior := out.Header.Values("Forwarded"); len(prior) > 0 {
+		element = strings.Join(prior, ", ") + ", " + element
+	}
+
+	out.Header.Set("Forwarded", element)
+}
+
+func (p *ReverseProxy) handleError(r *route, w http.ResponseWriter, req *http.Request, err error) {
+	ctx := req.Context()
+	logger := logging.Logger(ctx, p.logger)
+
+	if errors.Is(err, context.Canceled) && ctx.Err() != nil {
+		logger.Debug("client went away while proxying request", zap.String("route", r.prefix), zap.Error(err))
+		return
+	}
+
+	logger.Debug("unable to proxy request to upstream", zap.String("route", r.prefix), zap.Stringer("upstream", r.upstream), zap.Error(err))
+
+	if isTimeout(err) {
+		dhttp.WriteError(ctx, w, derr.HTTPGatewayTimeoutError(ctx, err, UpstreamTimeoutErrorCode, "The upstream service did not respond in time.", "route", r.prefix))
+		return
+	}
+
+	dhttp.WriteError(ctx, w, derr.HTTPBadGatewayError(ctx, err, UpstreamUnavailableErrorCode, "The upstream service is not currently available.", "route", r.prefix))
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func joinPath(base, path string) string {
+	switch {
+	case path == "":
+		if base == "" {
+			return "/"
+		}
+		return base
+	case strings.HasSuffix(base, "/") && strings.HasPrefix(path, "/"):
+		return base + path[1:]
+	case !strings.HasSuffix(base, "/") && !strings.HasPrefix(path, "/"):
+		return base + "/" + path
+	}
+
+	return base + path
+}
+
+// forwardedNode formats an IP as a `Forwarded` node, IPv6 addresses must be bracketed
+// and quoted.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+
+	return ip
+}
+
+func quoteForwardedValue(value string) string {
+	if strings.ContainsAny(value, ":[]") {
+		return `"` + value + `"`
+	}
+
+	return value
+}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/streamingfast/dhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReverseProxy_Routing(t *testing.T) {
+	echo := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Upstream", name)
+			fmt.Fprintf(w, "%s %s %s|%s|%s|%s", name, r.URL.RequestURI(), r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Host"), r.Header.Get("Forwarded"), r.Header.Get("X-Rewritten"))
+		}))
+	}
+
+	api := echo("api")
+	defer api.Close()
+	v2 := echo("v2")
+	defer v2.Close()
+
+	proxy, err := NewReverseProxy(
+		Route("/api", api.URL+"/base", StripPrefix()),
+		Route("/api/v2", v2.URL, RouteRewriteRequest(func(r *http.Request) { r.Header.Set("X-Rewritten", "true") })),
+		RewriteResponse(func(r *http.Response) error {
+			r.Header.Set("X-Proxied", "true")
+			return nil
+		}),
+	)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		path     string
+		expected string
+	}{
+		{"strip prefix", "/api/users?id=1", "api /base/users?id=1"},
+		{"prefix only", "/api", "api /base"},
+		{"most specific route", "/api/v2/users", "v2 /api/v2/users"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "http://proxy.example.com"+test.path, nil)
+			request.RemoteAddr = "10.0.0.1:5000"
+			request.Header.Set("X-Forwarded-For", "1.2.3.4")
+
+			recorder := httptest.NewRecorder()
+			proxy.ServeHTTP(recorder, request)
+
+			require.Equal(t, http.StatusOK, recorder.Code)
+			assert.Equal(t, "true", recorder.Header().Get("X-Proxied"))
+			assert.Contains(t, recorder.Body.String(), test.expected+" 10.0.0.1|proxy.example.com|for=10.0.0.1;host=proxy.example.com;proto=http|")
+		})
+	}
+
+	t.Run("route rewrite", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/v2", nil))
+
+		assert.Contains(t, recorder.Body.String(), "|true")
+	})
+
+	t.Run("no route", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, httptest.NewRequest("GET", "/apiother", nil))
+
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+		assert.Equal(t, string(RouteNotFoundErrorCode), errorCode(t, recorder))
+	})
+}
+
+func TestReverseProxy_TrustForwardedHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s", r.Header.Get("X-Forwarded-For"), r.Header.Get("Forwarded"))
+	}))
+	defer upstream.Close()
+
+	proxy, err := NewReverseProxy(Route("/", upstream.URL), TrustForwardedHeaders())
+	require.NoError(t, err)
+
+	request := httptest.NewRequest("GET", "http://proxy/", nil)
+	request.RemoteAddr = "[::1]:5000"
+	request.Header.Set("X-Forwarded-For", "1.2.3.4")
+	request.Header.Set("Forwarded", "for=1.2.3.4")
+
+	recorder := httptest.NewRecorder()
+	proxy.ServeHTTP(recorder, request)
+
+	assert.Equal(t, `1.2.3.4, ::1|for=1.2.3.4, for="[::1]";host=proxy;proto=http`, recorder.Body.String())
+}
+
+func TestReverseProxy_Errors(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedURL := "http://" + listener.Addr().String()
+	listener.Close()
+
+	proxy, err := NewReverseProxy(
+		Route("/slow", slow.URL, RouteTransport(&http.Transport{ResponseHeaderTimeout: 20 * time.Millisecond})),
+		Route("/down", closedURL),
+		Route("/rejected", slow.URL, RouteRewriteResponse(func(r *http.Response) error { return fmt.Errorf("rejected") })),
+	)
+	require.NoError(t, err)
+
+	tests := []struct {
+		path         string
+		expectedCode int
+		expectedErr  string
+	}{
+		{"/slow", http.StatusGatewayTimeout, string(UpstreamTimeoutErrorCode)},
+		{"/down", http.StatusBadGateway, string(UpstreamUnavailableErrorCode)},
+		{"/rejected", http.StatusBadGateway, string(UpstreamUnavailableErrorCode)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			proxy.ServeHTTP(recorder, httptest.NewRequest("GET", test.path, nil))
+
+			assert.Equal(t, test.expectedCode, recorder.Code)
+			assert.Equal(t, test.expectedErr, errorCode(t, recorder))
+		})
+	}
+}
+
+func TestReverseProxy_Upgrade(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		conn, buffered, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buffered.Flush()
+
+		line, _ := buffered.ReadString('\n')
+		buffered.WriteString("echo: " + line)
+		buffered.Flush()
+	}))
+	defer upstream.Close()
+
+	transports := map[string]http.RoundTripper{
+		"default transport":           nil,
+		"tracing round tripper":       dhttp.NewTracingRoundTripper(nil),
+		"rate limit round tripper":    dhttp.NewRateLimitingRoundTripper(nil),
+		"response body round tripper": dhttp.NewResponseBodyRoundTripper(nil),
+		"har round tripper":           dhttp.NewHARRoundTripper(dhttp.NewHARWriter(io.Discard), nil),
+		"hedging round tripper":       dhttp.NewHedgingRoundTripper(nil),
+	}
+
+	for name, transport := range transports {
+		t.Run(name, func(t *testing.T) {
+			var routeOptions []RouteOption
+			if transport != nil {
+				routeOptions = append(routeOptions, RouteTransport(transport))
+			}
+
+			proxy, err := NewReverseProxy(Route("/", upstream.URL, routeOptions...))
+			require.NoError(t, err)
+
+			server := httptest.NewServer(proxy)
+			defer server.Close()
+
+			conn, err := net.Dial("tcp", server.Listener.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+
+			fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: proxy\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+
+			reader := bufio.NewReader(conn)
+			response, err := http.ReadResponse(reader, nil)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+
+			fmt.Fprintf(conn, "hello\n")
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, "echo: hello\n", line)
+		})
+	}
+}
+
+func TestNewReverseProxy_InvalidConfig(t *testing.T) {
+	_, err := NewReverseProxy()
+	assert.Error(t, err)
+
+	_, err = NewReverseProxy(Route("/", "localhost"))
+	assert.Error(t, err)
+}
+
+func errorCode(t *testing.T, recorder *httptest.ResponseRecorder) string {
+	var body struct {
+		Code string `json:"code"`
+	}
+
+	content, err := io.ReadAll(recorder.Body)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(content, &body), string(content))
+
+	return body.Code
+}
@@ -0,0 +1,381 @@
+package dhttp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/streamingfast/logging"
+	"go.uber.org/zap"
+)
+
+// defaultThrottleDelay is the pause applied to a key when upstream responds with
+// `429 Too Many Requests` without a usable `Retry-After` header.
+const defaultThrottleDelay = 1 * time.Second
+
+// limiterIdleTimeout is how long a key must go without requests before its limiter is
+// forgotten, provided it holds no state anymore (full bucket, nothing in flight, not paused).
+const limiterIdleTimeout = 1 * time.Minute
+
+type RateLimitOption func(t *RateLimitingRoundTripper)
+
+// RateLimit sets the sustained rate, in requests per second, and the burst size of the
+// token bucket of each key. A rate lower or equal to 0 disables rate limiting.
+func RateLimit(requestsPerSecond float64, burst int) RateLimitOption {
+	return func(t *RateLimitingRoundTripper) {
+		t.rate = requestsPerSecond
+		t.burst = burst
+	}
+}
+
+// RateLimitMaxInFlight sets the maximum number of concurrent requests of each key, a
+// request is in flight until its response body is closed. A value lower or equal to 0
+// disables concurrency limiting.
+func RateLimitMaxInFlight(maxInFlight int) RateLimitOption {
+	return func(t *RateLimitingRoundTripper) {
+		t.maxInFlight = maxInFlight
+	}
+}
+
+// RateLimitKey sets the function used to determine the key under which a request is
+// limited, defaults to the request's host (`Request.URL.Host`).
+func RateLimitKey(keyFunc func(r *http.Request) string) RateLimitOption {
+	return func(t *RateLimitingRoundTripper) {
+		t.keyFunc = keyFunc
+	}
+}
+
+// RateLimitLogger sets the logger used to log upstream throttling, the request specific
+// logger is used if one exists in the request's context.
+func RateLimitLogger(logger *zap.Logger) RateLimitOption {
+	return func(t *RateLimitingRoundTripper) {
+		t.logger = logger
+	}
+}
+
+// NewRateLimitingRoundTripper creates a wrapping `http.RoundTripper` that enforces a token
+// bucket rate limit as well as a maximum number of in-flight requests per key (the request's
+// host by default, see `RateLimitKey`).
+//
+// When no capacity is available, the request blocks until there is or until the request's
+// context is done, in which case the context's error is returned.
+//
+// When upstream responds with `429 Too Many Requests`, requests of the key are paused for
+// the duration given by the `Retry-After` header (1s if absent) and the key's rate is halved,
+// it then recovers progressively toward the configured rate as requests succeed.
+//
+// The state of keys not requested for a minute is forgotten once their bucket is full, so
+// keys can be unbounded (client IPs, tokens) without the memory usage growing forever.
+//
+// If the received `next` argument is set as `nil`, the `http.DefaultTransport` value
+// will be used as the actual transport handler.
+func NewRateLimitingRoundTripper(next http.RoundTripper, opts ...RateLimitOption) *RateLimitingRoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	t := &RateLimitingRoundTripper{
+		transport: next,
+		logger:    zlog,
+		keyFunc:   func(r *http.Request) string { return r.URL.Host },
+		now:       time.Now,
+		limiters:  map[string]*keyLimiter{},
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	if t.burst <= 0 {
+		t.burst = 1
+	}
+
+	return t
+}
+
+type RateLimitingRoundTripper struct {
+	transport   http.RoundTripper
+	logger      *zap.Logger
+	rate        float64
+	burst       int
+	maxInFlight int
+	keyFunc     func(r *http.Request) string
+	now         func() time.Time
+
+	lock      sync.Mutex
+	limiters  map[string]*keyLimiter
+	lastPurge time.Time
+}
+
+func (t *RateLimitingRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	ctx := request.Context()
+	key := t.keyFunc(request)
+	limiter := t.limiter(key)
+
+	release, err := limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := t.transport.RoundTrip(request)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	if response.StatusCode == http.StatusTooManyRequests {
+		delay, found := parseRetryAfter(response.Header.Get("Retry-After"), t.now())
+		if !found {
+			delay = defaultThrottleDelay
+		}
+
+		rate := limiter.throttle(delay)
+		logging.Logger(ctx, t.logger).Debug(fmt.Sprintf("upstream throttled HTTP requests of %q", key),
+			zap.Duration("pause", delay),
+			zap.Float64("rate", rate),
+		)
+	} else {
+		limiter.restoreRate()
+	}
+
+	response.Body = newReleasingBody(response.Body, release)
+	return response, nil
+}
+
+func (t *RateLimitingRoundTripper) limiter(key string) *keyLimiter {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := t.now()
+	if now.Sub(t.lastPurge) > limiterIdleTimeout {
+		t.purgeIdleLimiters(now)
+		t.lastPurge = now
+	}
+
+	limiter, found := t.limiters[key]
+	if !found {
+		limiter = &keyLimiter{
+			configuredRate: t.rate,
+			rate:           t.rate,
+			burst:          float64(t.burst),
+			tokens:         float64(t.burst),
+			last:           t.now(),
+			now:            t.now,
+		}
+
+		if t.maxInFlight > 0 {
+			limiter.inFlight = make(chan struct{}, t.maxInFlight)
+		}
+
+		t.limiters[key] = limiter
+	}
+
+	limiter.lastUsed = now
+	return limiter
+}
+
+// purgeIdleLimiters forgets the limiters of keys not requested for `limiterIdleTimeout`
+// that hold no state anymore. Must be called with `t.lock` held.
+func (t *RateLimitingRoundTripper) purgeIdleLimiters(now time.Time) {
+	for key, limiter := range t.limiters {
+		if now.Sub(limiter.lastUsed) > limiterIdleTimeout && limiter.idle(now) {
+			delete(t.limiters, key)
+		}
+	}
+}
+
+type keyLimiter struct {
+	inFlight chan struct{}
+	now      func() time.Time
+
+	// lastUsed is protected by the round tripper's lock
+	lastUsed time.Time
+
+	lock           sync.Mutex
+	configuredRate float64
+	rate           float64
+	burst          float64
+	tokens         float64
+	last           time.Time
+	pausedUntil    time.Time
+}
+
+// acquire blocks until both a token and an in-flight slot are available, the returned
+// function must be called to release the in-flight slot.
+func (l *keyLimiter) acquire(ctx context.Context) (release func(), err error) {
+	if err := l.waitToken(ctx); err != nil {
+		return nil, err
+	}
+
+	if l.inFlight == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case l.inFlight <- struct{}{}:
+	case <-ctx.Done():
+		// The request is not sent, its token can be used by another one
+		l.refund()
+		return nil, ctx.Err()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-l.inFlight })
+	}, nil
+}
+
+func (l *keyLimiter) waitToken(ctx context.Context) error {
+	delay := l.reserve()
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.refund()
+		return ctx.Err()
+	}
+}
+
+// reserve takes a token, possibly going in debt, and returns how long the caller
+// must wait before the token is actually available.
+func (l *keyLimiter) reserve() time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+
+	var delay time.Duration
+	if l.configuredRate > 0 {
+		l.refill(now)
+		l.tokens--
+
+		if l.tokens < 0 {
+			delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+		}
+	}
+
+	if pause := l.pausedUntil.Sub(now); pause > delay {
+		delay = pause
+	}
+
+	return delay
+}
+
+// idle returns whether the limiter is back to the state of a new one, nothing being in
+// flight, no pause being in effect and its bucket being full.
+func (l *keyLimiter) idle(now time.Time) bool {
+	if len(l.inFlight) > 0 {
+		return false
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.Before(l.pausedUntil) {
+		return false
+	}
+
+	if l.configuredRate > 0 {
+		l.refill(now)
+		return l.tokens >= l.burst
+	}
+
+	return true
+}
+
+func (l *keyLimiter) refund() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.configuredRate > 0 {
+		l.tokens++
+	}
+}
+
+func (l *keyLimiter) refill(now time.Time) {
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+
+	l.last = now
+}
+
+// throttle pauses the limiter for the given delay and halves its rate, returning
+// the new rate.
+func (l *keyLimiter) throttle(delay time.Duration) float64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	if pausedUntil := now.Add(delay); pausedUntil.After(l.pausedUntil) {
+		l.pausedUntil = pausedUntil
+	}
+
+	if l.configuredRate > 0 {
+		l.refill(now)
+		l.rate = l.rate / 2
+		if minRate := l.configuredRate / 16; l.rate < minRate {
+			l.rate = minRate
+		}
+	}
+
+	return l.rate
+}
+
+// restoreRate increases the rate back toward the configured rate after a successful request.
+func (l *keyLimiter) restoreRate() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.rate >= l.configuredRate {
+		return
+	}
+
+	l.refill(l.now())
+	l.rate += l.configuredRate / 10
+	if l.rate > l.configuredRate {
+		l.rate = l.configuredRate
+	}
+}
+
+// newReleasingBody wraps `body` so that `release` is invoked once it's closed. The body of
+// a `101 Switching Protocols` response is an `io.ReadWriteCloser`, which stays writable
+// once wrapped so that connection upgrades keep working.
+func newReleasingBody(body io.ReadCloser, release func()) io.ReadCloser {
+	releasing := &releasingBody{ReadCloser: body, release: release}
+	if writer, ok := body.(io.Writer); ok {
+		return &releasingReadWriteBody{releasingBody: releasing, Writer: writer}
+	}
+
+	return releasing
+}
+
+// releasingBody releases the in-flight slot of the request once the body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	defer b.release()
+
+	return b.ReadCloser.Close()
+}
+
+type releasingReadWriteBody struct {
+	*releasingBody
+	io.Writer
+}
@@ -0,0 +1,129 @@
+package dhttp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitingRoundTripper(t *testing.T) {
+	okTransport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	})
+
+	throttledTransport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 429, Header: http.Header{"Retry-After": []string{"10"}}, Body: http.NoBody}, nil
+	})
+
+	roundTrip := func(transport http.RoundTripper, timeout time.Duration) (*http.Response, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		request, _ := http.NewRequestWithContext(ctx, "GET", "http://upstream/", nil)
+		return transport.RoundTrip(request)
+	}
+
+	t.Run("rate", func(t *testing.T) {
+		transport := NewRateLimitingRoundTripper(okTransport, RateLimit(1, 2))
+
+		for i := 0; i < 2; i++ {
+			_, err := roundTrip(transport, 10*time.Millisecond)
+			require.NoError(t, err, "burst request %d", i)
+		}
+
+		_, err := roundTrip(transport, 10*time.Millisecond)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("max in flight", func(t *testing.T) {
+		transport := NewRateLimitingRoundTripper(okTransport, RateLimitMaxInFlight(1))
+
+		first, err := roundTrip(transport, time.Second)
+		require.NoError(t, err)
+
+		_, err = roundTrip(transport, 10*time.Millisecond)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		first.Body.Close()
+		second, err := roundTrip(transport, 10*time.Millisecond)
+		require.NoError(t, err)
+		second.Body.Close()
+	})
+
+	t.Run("throttled by upstream", func(t *testing.T) {
+		transport := NewRateLimitingRoundTripper(throttledTransport, RateLimit(100, 10))
+
+		response, err := roundTrip(transport, time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, 429, response.StatusCode)
+		assert.Equal(t, 50.0, transport.limiter("upstream").rate)
+
+		_, err = roundTrip(transport, 10*time.Millisecond)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("token refunded when waiting for in flight slot", func(t *testing.T) {
+		transport := NewRateLimitingRoundTripper(okTransport, RateLimit(0.001, 2), RateLimitMaxInFlight(1))
+
+		first, err := roundTrip(transport, time.Second)
+		require.NoError(t, err)
+
+		_, err = roundTrip(transport, 10*time.Millisecond)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		first.Body.Close()
+		second, err := roundTrip(transport, 10*time.Millisecond)
+		require.NoError(t, err, "the cancelled request token should have been refunded")
+		second.Body.Close()
+	})
+
+	t.Run("upgraded body stays writable", func(t *testing.T) {
+		upgradeTransport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusSwitchingProtocols, Body: &readWriteCloser{}}, nil
+		})
+
+		transport := NewRateLimitingRoundTripper(upgradeTransport, RateLimitMaxInFlight(1))
+
+		response, err := roundTrip(transport, time.Second)
+		require.NoError(t, err)
+
+		_, writable := response.Body.(io.ReadWriteCloser)
+		assert.True(t, writable)
+	})
+}
+
+// readWriteCloser mimics the body of a `101 Switching Protocols` response
+type readWriteCloser struct {
+	bytes.Buffer
+}
+
+func (*readWriteCloser) Close() error { return nil }
+
+func TestRateLimitingRoundTripper_PurgeIdleLimiters(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	transport := NewRateLimitingRoundTripper(nil, RateLimit(1, 2), RateLimitMaxInFlight(1))
+	transport.now = func() time.Time { return now }
+
+	release, err := transport.limiter("idle").acquire(context.Background())
+	require.NoError(t, err)
+	release()
+
+	_, err = transport.limiter("in-flight").acquire(context.Background())
+	require.NoError(t, err)
+
+	transport.limiter("paused").throttle(time.Hour)
+
+	now = now.Add(2 * time.Minute)
+	transport.limiter("active")
+
+	assert.Len(t, transport.limiters, 3)
+	assert.Contains(t, transport.limiters, "in-flight")
+	assert.Contains(t, transport.limiters, "paused")
+	assert.Contains(t, transport.limiters, "active")
+}
@@ -0,0 +1,41 @@
+package dhttp
+
+import (
+	"net/http"
+)
+
+const redactedHeaderValue = "[REDACTED]"
+
+// DefaultRedactedHeaders are the headers whose values are redacted when HTTP traffic
+// is persisted outside of the process (cassettes, HTTP archives).
+var DefaultRedactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Api-Key",
+	"X-Auth-Token",
+}
+
+// redactHeaders returns a copy of `header` where the values of the `redacted` headers
+// are replaced by a placeholder, header names are matched case-insensitively.
+func redactHeaders(header http.Header, redacted []string) http.Header {
+	out := header.Clone()
+	if out == nil {
+		return http.Header{}
+	}
+
+	for _, name := range redacted {
+		name = http.CanonicalHeaderKey(name)
+		if values, found := out[name]; found {
+			redactedValues := make([]string, len(values))
+			for i := range values {
+				redactedValues[i] = redactedHeaderValue
+			}
+
+			out[name] = redactedValues
+		}
+	}
+
+	return out
+}
@@ -3,6 +3,7 @@ package dhttp
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -16,6 +17,10 @@ import (
 	"go.uber.org/zap"
 )
 
+// RequestBodyTooLargeErrorCode is the `derr.ErrorCode` of the `413 Request Entity Too Large`
+// error returned when a request body exceeds its size limit.
+const RequestBodyTooLargeErrorCode derr.ErrorCode = "request_body_too_large_error"
+
 var decoder = schema.NewDecoder()
 
 func init() {
@@ -43,6 +48,11 @@ func ExtractJSONRequest(ctx context.Context, r *http.Request, request interface{
 
 	err := json.NewDecoder(r.Body).Decode(request)
 	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return RequestBodyTooLargeError(ctx, maxBytesErr, maxBytesErr.Limit)
+		}
+
 		return derr.InvalidJSONError(ctx, err)
 	}
 
@@ -54,6 +64,11 @@ func ExtractJSONRequest(ctx context.Context, r *http.Request, request interface{
 	return nil
 }
 
+// RequestBodyTooLargeError is the error of a request body bigger than `limit` bytes.
+func RequestBodyTooLargeError(ctx context.Context, cause error, limit int64) *derr.ErrorResponse {
+	return derr.HTTPRequestEntityTooLargeError(ctx, cause, RequestBodyTooLargeErrorCode, "The request body is too large.", "limit", limit)
+}
+
 func requestToSchemaDecodingMap(r *http.Request) url.Values {
 	variables := r.URL.Query()
 
@@ -1,6 +1,7 @@
 package dhttp
 
 import (
+	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
@@ -9,6 +10,7 @@ import (
 	"github.com/streamingfast/derr"
 	"github.com/streamingfast/validator"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_ExtractRequest(t *testing.T) {
@@ -86,3 +88,19 @@ func Test_ExtractJSONRequest(t *testing.T) {
 		JSON:   true,
 	}, request)
 }
+
+func Test_ExtractJSONRequest_BodyTooLarge(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", strings.NewReader(`{"prefix":"a long prefix"}`))
+	r.Body = http.MaxBytesReader(recorder, r.Body, 10)
+	ctx := newTestContext(r.Context())
+
+	request := &struct {
+		Prefix string `json:"prefix"`
+	}{}
+	err := ExtractJSONRequest(ctx, r, request, NewJSONRequestValidator(validator.Rules{}))
+
+	require.Error(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, err.(*derr.ErrorResponse).Status)
+	assert.Equal(t, RequestBodyTooLargeErrorCode, err.(*derr.ErrorResponse).Code)
+}
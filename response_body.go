@@ -0,0 +1,290 @@
+package dhttp
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/streamingfast/logging"
+	"go.uber.org/zap"
+)
+
+// supportedEncodings are the content encodings a `ResponseBodyRoundTripper` decompresses,
+// in the order they are advertised in `Accept-Encoding`.
+var supportedEncodings = []string{"gzip", "br", "zstd"}
+
+// zstdMaxWindowSize and zstdMaxMemory bound the memory a zstd decoder allocates, 8 MiB
+// being the window size decoders are expected to support for HTTP (RFC 8878, section 3.1.1.1.2).
+const (
+	zstdMaxWindowSize = 8 * 1024 * 1024
+	zstdMaxMemory     = 64 * 1024 * 1024
+)
+
+// ResponseTooLargeError is returned when reading a response body bigger than the limit
+// configured on a `ResponseBodyRoundTripper`.
+type ResponseTooLargeError struct {
+	Limit int64
+	URL   string
+}
+
+func (e *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("response body of %s exceeds the %d bytes limit", e.URL, e.Limit)
+}
+
+type ResponseBodyOption func(t *ResponseBodyRoundTripper)
+
+// ResponseMaxBodySize sets the maximum size of a response body, decompressed size if the
+// body is decompressed, defaults to 64 MiB. A value lower or equal to 0 disables the limit.
+func ResponseMaxBodySize(maxBodySize int64) ResponseBodyOption {
+	return func(t *ResponseBodyRoundTripper) {
+		t.maxBodySize = maxBodySize
+	}
+}
+
+// ResponseDecompression enables or disables the transparent decompression of response
+// bodies, enabled by default.
+func ResponseDecompression(enabled bool) ResponseBodyOption {
+	return func(t *ResponseBodyRoundTripper) {
+		t.decompress = enabled
+	}
+}
+
+// ResponseBodyLogger sets the logger used to log body sizes, the request specific logger
+// is used if one exists in the request's context.
+func ResponseBodyLogger(logger *zap.Logger) ResponseBodyOption {
+	return func(t *ResponseBodyRoundTripper) {
+		t.logger = logger
+	}
+}
+
+// NewResponseBodyRoundTripper creates a wrapping `http.RoundTripper` guarding against
+// unbounded response bodies, reading more than `ResponseMaxBodySize` bytes fails with
+// a `*ResponseTooLargeError`, the failure happening right away if the response's
+// `Content-Length` is already over the limit.
+//
+// When the request has no `Accept-Encoding` header, it adds one advertising `gzip`, `br`
+// and `zstd` and transparently decompresses the response body, removing its
+// `Content-Encoding` and `Content-Length` headers. Requests with their own
+// `Accept-Encoding` header are left untouched and so is their response body.
+//
+// Once the body has been fully read or closed, its compressed and uncompressed sizes are
+// logged at debug level. The upgraded connection of `101 Switching Protocols` responses is
+// returned as is.
+//
+// If the received `next` argument is set as `nil`, the `http.DefaultTransport` value
+// will be used as the actual transport handler.
+func NewResponseBodyRoundTripper(next http.RoundTripper, opts ...ResponseBodyOption) *ResponseBodyRoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	t := &ResponseBodyRoundTripper{
+		transport:   next,
+		logger:      zlog,
+		maxBodySize: 64 * 1024 * 1024,
+		decompress:  true,
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	return t
+}
+
+type ResponseBodyRoundTripper struct {
+	transport   http.RoundTripper
+	logger      *zap.Logger
+	maxBodySize int64
+	decompress  bool
+}
+
+func (t *ResponseBodyRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	addedAcceptEncoding := false
+	if t.decompress && request.Header.Get("Accept-Encoding") == "" && request.Header.Get("Range") == "" {
+		request = request.Clone(request.Context())
+		request.Header.Set("Accept-Encoding", strings.Join(supportedEncodings, ", "))
+		addedAcceptEncoding = true
+	}
+
+	response, err := t.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode == http.StatusSwitchingProtocols {
+		// The body is the upgraded connection (an `io.ReadWriteCloser`), not a body to limit
+		return response, nil
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(response.Header.Get("Content-Encoding")))
+	decode := addedAcceptEncoding && isSupportedEncoding(encoding) && hasResponseBody(request, response)
+
+	if t.maxBodySize > 0 && !decode && response.ContentLength > t.maxBodySize {
+		response.Body.Close()
+		return nil, &ResponseTooLargeError{Limit: t.maxBodySize, URL: request.URL.String()}
+	}
+
+	raw := &countingReader{reader: response.Body}
+	body := &responseBody{
+		raw:     raw,
+		closer:  response.Body,
+		limit:   t.maxBodySize,
+		url:     request.URL.String(),
+		decoded: raw,
+		onDone: func(compressed, uncompressed int64) {
+			logging.Logger(request.Context(), t.logger).Debug(fmt.Sprintf("HTTP response body of %s %s read", request.Method, request.URL.String()),
+				zap.String("encoding", encoding),
+				zap.Int64("compressed_bytes", compressed),
+				zap.Int64("uncompressed_bytes", uncompressed),
+			)
+		},
+	}
+
+	if decode {
+		body.encoding = encoding
+		body.decoded = nil
+
+		response.Header.Del("Content-Encoding")
+		response.Header.Del("Content-Length")
+		response.ContentLength = -1
+		response.Uncompressed = true
+	}
+
+	response.Body = body
+	return response, nil
+}
+
+// hasResponseBody returns false when the response is known to have no body, there is
+// nothing to decode then.
+func hasResponseBody(request *http.Request, response *http.Response) bool {
+	if request.Method == http.MethodHead || response.ContentLength == 0 {
+		return false
+	}
+
+	return response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusNotModified
+}
+
+func isSupportedEncoding(encoding string) bool {
+	for _, supported := range supportedEncodings {
+		if encoding == supported {
+			return true
+		}
+	}
+
+	return false
+}
+
+// responseBody decodes (lazily, on first read) and limits a response body.
+type responseBody struct {
+	raw      *countingReader
+	closer   io.Closer
+	encoding string
+	limit    int64
+	url      string
+	onDone   func(compressed, uncompressed int64)
+
+	decoded      io.Reader
+	decoderClose func()
+	read         int64
+	err          error
+	doneOnce     sync.Once
+}
+
+func (b *responseBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	if b.decoded == nil {
+		if err := b.initDecoder(); err != nil {
+			b.err = err
+			return 0, err
+		}
+	}
+
+	if b.limit > 0 {
+		// Read one byte past the limit to detect bodies exceeding it
+		if remaining := b.limit + 1 - b.read; int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+
+	n, err := b.decoded.Read(p)
+	b.read += int64(n)
+
+	if b.limit > 0 && b.read > b.limit {
+		n -= int(b.read - b.limit)
+		b.read = b.limit
+		err = &ResponseTooLargeError{Limit: b.limit, URL: b.url}
+	}
+
+	if err != nil {
+		b.err = err
+		b.done()
+	}
+
+	return n, err
+}
+
+func (b *responseBody) Close() error {
+	b.done()
+	if b.decoderClose != nil {
+		b.decoderClose()
+	}
+
+	return b.closer.Close()
+}
+
+func (b *responseBody) initDecoder() error {
+	switch b.encoding {
+	case "gzip":
+		reader, err := gzip.NewReader(b.raw)
+		if err == io.EOF {
+			// Empty body of unknown length, there is nothing to decode
+			b.decoded = b.raw
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("unable to decode gzip response body: %w", err)
+		}
+
+		b.decoded = reader
+	case "br":
+		b.decoded = brotli.NewReader(b.raw)
+	case "zstd":
+		decoder, err := zstd.NewReader(b.raw, zstd.WithDecoderMaxMemory(zstdMaxMemory), zstd.WithDecoderMaxWindow(zstdMaxWindowSize))
+		if err != nil {
+			return fmt.Errorf("unable to decode zstd response body: %w", err)
+		}
+
+		b.decoded = decoder
+		b.decoderClose = decoder.Close
+	default:
+		b.decoded = b.raw
+	}
+
+	return nil
+}
+
+func (b *responseBody) done() {
+	b.doneOnce.Do(func() { b.onDone(b.raw.count, b.read) })
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+
+	return n, err
+}
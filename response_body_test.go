@@ -0,0 +1,156 @@
+package dhttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseBodyRoundTripper_Decompression(t *testing.T) {
+	payload := strings.Repeat("compressible payload ", 100)
+
+	encoders := map[string]func(w io.Writer) io.WriteCloser{
+		"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"br":   func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+		"zstd": func(w io.Writer) io.WriteCloser {
+			encoder, err := zstd.NewWriter(w)
+			require.NoError(t, err)
+			return encoder
+		},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.URL.Query().Get("encoding")
+		if encoding == "" || !strings.Contains(r.Header.Get("Accept-Encoding"), encoding) {
+			w.Write([]byte(payload))
+			return
+		}
+
+		buffer := bytes.NewBuffer(nil)
+		encoder := encoders[encoding](buffer)
+		encoder.Write([]byte(payload))
+		encoder.Close()
+
+		w.Header().Set("Content-Encoding", encoding)
+		w.Write(buffer.Bytes())
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewResponseBodyRoundTripper(nil)}
+
+	for _, encoding := range []string{"", "gzip", "br", "zstd"} {
+		t.Run("encoding "+encoding, func(t *testing.T) {
+			response, err := client.Get(server.URL + "?encoding=" + encoding)
+			require.NoError(t, err)
+			defer response.Body.Close()
+
+			body, err := io.ReadAll(response.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, payload, string(body))
+			assert.Empty(t, response.Header.Get("Content-Encoding"))
+		})
+	}
+
+	t.Run("caller accept encoding is untouched", func(t *testing.T) {
+		request, _ := http.NewRequest("GET", server.URL+"?encoding=gzip", nil)
+		request.Header.Set("Accept-Encoding", "gzip")
+
+		response, err := client.Do(request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+
+		assert.Equal(t, "gzip", response.Header.Get("Content-Encoding"))
+	})
+}
+
+func TestResponseBodyRoundTripper_EmptyBody(t *testing.T) {
+	tests := []struct {
+		name          string
+		statusCode    int
+		contentLength int64
+	}{
+		{"not modified", http.StatusNotModified, 0},
+		{"no content", http.StatusNoContent, 0},
+		{"empty body of unknown length", http.StatusOK, -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode:    test.statusCode,
+					Header:        http.Header{"Content-Encoding": []string{"gzip"}},
+					ContentLength: test.contentLength,
+					Body:          http.NoBody,
+				}, nil
+			})
+
+			request, _ := http.NewRequest("GET", "http://upstream/", nil)
+			response, err := NewResponseBodyRoundTripper(transport).RoundTrip(request)
+			require.NoError(t, err)
+			defer response.Body.Close()
+
+			body, err := io.ReadAll(response.Body)
+			require.NoError(t, err)
+			assert.Empty(t, body)
+		})
+	}
+}
+
+func TestResponseBodyRoundTripper_Limit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("chunked") != "" {
+			w.Write([]byte(strings.Repeat("a", 10)))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(strings.Repeat("a", 10)))
+			return
+		}
+
+		w.Write([]byte(strings.Repeat("a", 20)))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewResponseBodyRoundTripper(nil, ResponseMaxBodySize(15))}
+
+	t.Run("content length over limit", func(t *testing.T) {
+		_, err := client.Get(server.URL)
+
+		var tooLarge *ResponseTooLargeError
+		require.ErrorAs(t, err, &tooLarge)
+		assert.Equal(t, int64(15), tooLarge.Limit)
+	})
+
+	t.Run("streamed body over limit", func(t *testing.T) {
+		response, err := client.Get(server.URL + "?chunked=true")
+		require.NoError(t, err)
+		defer response.Body.Close()
+
+		body, err := io.ReadAll(response.Body)
+
+		var tooLarge *ResponseTooLargeError
+		require.ErrorAs(t, err, &tooLarge)
+		assert.Len(t, body, 15)
+	})
+
+	t.Run("body at limit", func(t *testing.T) {
+		client := &http.Client{Transport: NewResponseBodyRoundTripper(nil, ResponseMaxBodySize(20))}
+
+		response, err := client.Get(server.URL + "?chunked=true")
+		require.NoError(t, err)
+		defer response.Body.Close()
+
+		body, err := io.ReadAll(response.Body)
+		require.NoError(t, err)
+		assert.Len(t, body, 20)
+	})
+}
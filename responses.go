@@ -3,6 +3,7 @@ package dhttp
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -88,6 +89,13 @@ func WriteError(ctx context.Context, w http.ResponseWriter, err error) {
 	ctx, span := dtracing.StartSpan(ctx, "write error response", "type", fmt.Sprintf("%T", err))
 	defer span.End()
 
+	// A body read past an `http.MaxBytesReader` limit is the client's fault, not ours
+	var errorResponse *derr.ErrorResponse
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(err, &errorResponse) && errors.As(err, &maxBytesErr) {
+		err = RequestBodyTooLargeError(ctx, err, maxBytesErr.Limit)
+	}
+
 	derr.WriteError(ctx, w, "unable to fullfil request", err)
 }
 
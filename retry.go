@@ -0,0 +1,303 @@
+package dhttp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/streamingfast/logging"
+	"go.uber.org/zap"
+)
+
+// DefaultRetryStatusCodes are the response status codes retried by a `RetryingRoundTripper`
+// when no `RetryOnStatusCodes` option is provided.
+var DefaultRetryStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// idempotentMethods are the methods defined as idempotent by RFC 9110, section 9.2.2.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// maxDrainBytes is the maximum amount of bytes read from a discarded response body so
+// that the underlying connection can be re-used, bigger bodies are simply closed.
+const maxDrainBytes = 64 * 1024
+
+type RetryOption func(t *RetryingRoundTripper)
+
+// RetryMaxAttempts sets the maximum number of attempts performed, including the
+// first one, defaults to 4.
+func RetryMaxAttempts(attempts int) RetryOption {
+	return func(t *RetryingRoundTripper) {
+		t.maxAttempts = attempts
+	}
+}
+
+// RetryBackoff sets the initial and maximum delay used to compute the exponential
+// backoff between attempts, defaults to 100ms and 5s respectively.
+func RetryBackoff(initial time.Duration, max time.Duration) RetryOption {
+	return func(t *RetryingRoundTripper) {
+		t.initialBackoff = initial
+		t.maxBackoff = max
+	}
+}
+
+// RetryMaxRetryAfter sets the longest `Retry-After` delay honoured, a response asking to
+// wait longer is returned to the caller instead of being retried. Defaults to 30s.
+func RetryMaxRetryAfter(max time.Duration) RetryOption {
+	return func(t *RetryingRoundTripper) {
+		t.maxRetryAfter = max
+	}
+}
+
+// RetryOnStatusCodes sets the response status codes that are retried, replacing
+// `DefaultRetryStatusCodes`.
+func RetryOnStatusCodes(statusCodes ...int) RetryOption {
+	return func(t *RetryingRoundTripper) {
+		t.statusCodes = map[int]bool{}
+		for _, statusCode := range statusCodes {
+			t.statusCodes[statusCode] = true
+		}
+	}
+}
+
+// RetryLogger sets the logger used to log retry attempts, the request specific logger
+// is used if one exists in the request's context.
+func RetryLogger(logger *zap.Logger) RetryOption {
+	return func(t *RetryingRoundTripper) {
+		t.logger = logger
+	}
+}
+
+// NewRetryingRoundTripper creates a wrapping `http.RoundTripper` that retries requests
+// that failed at the connection level or that received one of the configured status
+// codes (`DefaultRetryStatusCodes` by default).
+//
+// Only idempotent methods (`GET`, `HEAD`, `OPTIONS`, `TRACE`, `PUT` and `DELETE`) are
+// retried, non-idempotent ones are retried only if the request has an `Idempotency-Key`
+// header. Requests with a body are retried only if `Request.GetBody` is set to rewind
+// the body, which is the case for requests created by `http.NewRequest` with a
+// `bytes.Buffer`, `bytes.Reader` or `strings.Reader` body.
+//
+// The delay between attempts is an exponential backoff with full jitter, unless the
+// response has a `Retry-After` header in which case it's honoured up to `RetryMaxRetryAfter`,
+// the response being returned as is when upstream asks to wait longer. Errors that cannot
+// be fixed by retrying, like TLS certificate errors, are not retried. The request's context
+// is respected, the retrying stops as soon as the context is done or when the next
+// attempt would happen after the context's deadline.
+//
+// If the received `next` argument is set as `nil`, the `http.DefaultTransport` value
+// will be used as the actual transport handler. Wrap a `LoggingRoundTripper` to log
+// each attempt:
+//
+//	NewRetryingRoundTripper(NewLoggingRoundTripper(zlog, tracer, nil))
+func NewRetryingRoundTripper(next http.RoundTripper, opts ...RetryOption) *RetryingRoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	t := &RetryingRoundTripper{
+		transport:      next,
+		logger:         zlog,
+		maxAttempts:    4,
+		initialBackoff: 100 * time.Millisecond,
+		maxBackoff:     5 * time.Second,
+		maxRetryAfter:  30 * time.Second,
+	}
+
+	RetryOnStatusCodes(DefaultRetryStatusCodes...)(t)
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	return t
+}
+
+type RetryingRoundTripper struct {
+	transport      http.RoundTripper
+	logger         *zap.Logger
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	maxRetryAfter  time.Duration
+	statusCodes    map[int]bool
+}
+
+func (t *RetryingRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	if !t.isRetryable(request) {
+		return t.transport.RoundTrip(request)
+	}
+
+	ctx := request.Context()
+	logger := logging.Logger(ctx, t.logger)
+
+	for attempt := 1; ; attempt++ {
+		attemptRequest, err := rewindRequest(request, attempt)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := t.transport.RoundTrip(attemptRequest)
+		if attempt >= t.maxAttempts || !t.shouldRetry(ctx, response, err) {
+			return response, err
+		}
+
+		delay := t.backoff(attempt)
+		if response != nil {
+			if retryAfter, ok := parseRetryAfter(response.Header.Get("Retry-After"), time.Now()); ok {
+				if retryAfter > t.maxRetryAfter {
+					// Upstream asks to wait longer than we are willing to, let the caller deal with it
+					return response, err
+				}
+
+				delay = retryAfter
+			}
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			// There is no point retrying, we would be over the deadline, let the caller deal with the last outcome
+			return response, err
+		}
+
+		fields := []zap.Field{zap.Int("attempt", attempt), zap.Duration("delay", delay)}
+		if err != nil {
+			fields = append(fields, zap.String("error_class", classifyTransportError(err)), zap.Error(err))
+		} else {
+			fields = append(fields, zap.Int("status", response.StatusCode))
+			drainAndClose(response.Body)
+		}
+
+		logger.Debug(fmt.Sprintf("retrying HTTP request %s %s", request.Method, request.URL.String()), fields...)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (t *RetryingRoundTripper) isRetryable(request *http.Request) bool {
+	if request.Body != nil && request.Body != http.NoBody && request.GetBody == nil {
+		return false
+	}
+
+	return isIdempotent(request)
+}
+
+func (t *RetryingRoundTripper) shouldRetry(ctx context.Context, response *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if err != nil {
+		switch classifyTransportError(err) {
+		case transportErrorCancelled, transportErrorTLS:
+			return false
+		}
+
+		return true
+	}
+
+	return t.statusCodes[response.StatusCode]
+}
+
+func (t *RetryingRoundTripper) backoff(attempt int) time.Duration {
+	// Only shift when the result stays under the maximum, large attempts would overflow
+	ceiling := t.maxBackoff
+	if shift := attempt - 1; shift < 63 && t.initialBackoff <= t.maxBackoff>>shift {
+		ceiling = t.initialBackoff << shift
+	}
+
+	if ceiling <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// isIdempotent returns true if the request can be safely sent more than once, either
+// because its method is idempotent or because the client provided an idempotency key.
+func isIdempotent(request *http.Request) bool {
+	if idempotentMethods[request.Method] {
+		return true
+	}
+
+	return request.Header.Get("Idempotency-Key") != "" || request.Header.Get("X-Idempotency-Key") != ""
+}
+
+// rewindRequest returns the request to use for the given attempt, for retries, the body
+// is re-created through `GetBody`.
+func rewindRequest(request *http.Request, attempt int) (*http.Request, error) {
+	if attempt == 1 || request.Body == nil || request.Body == http.NoBody {
+		return request, nil
+	}
+
+	body, err := request.GetBody()
+	if err != nil {
+		return nil, fmt.Errorf("unable to rewind request body: %w", err)
+	}
+
+	rewound := request.Clone(request.Context())
+	rewound.Body = body
+
+	return rewound, nil
+}
+
+// parseRetryAfter parses a `Retry-After` header value which is either a number of seconds
+// or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+
+		if seconds > int64(math.MaxInt64/time.Second) {
+			return time.Duration(math.MaxInt64), true
+		}
+
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		delay := date.Sub(now)
+		if delay < 0 {
+			delay = 0
+		}
+
+		return delay, true
+	}
+
+	return 0, false
+}
+
+func drainAndClose(body io.ReadCloser) {
+	if body == nil {
+		return
+	}
+
+	io.CopyN(io.Discard, body, maxDrainBytes)
+	body.Close()
+}
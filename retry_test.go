@@ -0,0 +1,155 @@
+package dhttp
+
+import (
+	"context"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryingRoundTripper(t *testing.T) {
+	tests := []struct {
+		name             string
+		method           string
+		body             string
+		header           http.Header
+		failures         int32
+		expectedStatus   int
+		expectedAttempts int32
+	}{
+		{"get succeeds after failures", "GET", "", nil, 2, 200, 3},
+		{"get gives up after max attempts", "GET", "", nil, 10, 503, 4},
+		{"post is not retried", "POST", "body", nil, 2, 503, 1},
+		{"post with idempotency key is retried", "POST", "body", http.Header{"Idempotency-Key": []string{"abc"}}, 2, 200, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var attempts int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				assert.Equal(t, test.body, string(body))
+
+				if atomic.AddInt32(&attempts, 1) <= test.failures {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			client := &http.Client{Transport: NewRetryingRoundTripper(nil, RetryBackoff(time.Millisecond, 5*time.Millisecond))}
+
+			request, err := http.NewRequest(test.method, server.URL, strings.NewReader(test.body))
+			require.NoError(t, err)
+			for key, values := range test.header {
+				request.Header[key] = values
+			}
+
+			response, err := client.Do(request)
+			require.NoError(t, err)
+			response.Body.Close()
+
+			assert.Equal(t, test.expectedStatus, response.StatusCode)
+			assert.Equal(t, test.expectedAttempts, atomic.LoadInt32(&attempts))
+		})
+	}
+}
+
+func TestRetryingRoundTripper_RetryAfterTooLong(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.Header().Set("Retry-After", "86400")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewRetryingRoundTripper(nil, RetryMaxRetryAfter(time.Second))}
+
+	start := time.Now()
+	response, err := client.Get(server.URL)
+	require.NoError(t, err)
+	response.Body.Close()
+
+	assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRetryingRoundTripper_TLSErrorNotRetried(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	defer server.Close()
+
+	// The transport does not trust the test server's certificate
+	var dials int32
+	dialer := &net.Dialer{}
+	transport := &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return dialer.DialContext(ctx, network, addr)
+	}}
+
+	client := &http.Client{Transport: NewRetryingRoundTripper(transport, RetryBackoff(time.Millisecond, 5*time.Millisecond))}
+
+	_, err := client.Get(server.URL)
+	require.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dials))
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		value         string
+		expected      time.Duration
+		expectedFound bool
+	}{
+		{"empty", "", 0, false},
+		{"seconds", "3", 3 * time.Second, true},
+		{"negative seconds", "-3", 0, false},
+		{"http date", "Wed, 01 Jan 2020 00:00:10 GMT", 10 * time.Second, true},
+		{"http date in the past", "Tue, 31 Dec 2019 00:00:00 GMT", 0, true},
+		{"garbage", "soon", 0, false},
+		{"overflowing seconds", "100000000000", time.Duration(math.MaxInt64), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delay, found := parseRetryAfter(test.value, now)
+			assert.Equal(t, test.expectedFound, found)
+			assert.Equal(t, test.expected, delay)
+		})
+	}
+}
+
+func TestRetryingRoundTripper_backoff(t *testing.T) {
+	retrier := NewRetryingRoundTripper(nil, RetryBackoff(100*time.Millisecond, 5*time.Second))
+
+	for _, attempt := range []int{1, 10, 30, 37, 64, 100, 1000} {
+		for i := 0; i < 100; i++ {
+			delay := retrier.backoff(attempt)
+			require.GreaterOrEqual(t, delay, time.Duration(0), "attempt %d", attempt)
+			require.LessOrEqual(t, delay, 5*time.Second, "attempt %d", attempt)
+		}
+	}
+
+	// Full jitter over the maximum, a zero ceiling would always give 0
+	var total time.Duration
+	for i := 0; i < 100; i++ {
+		total += retrier.backoff(40)
+	}
+	assert.Greater(t, total, time.Duration(0))
+}
@@ -0,0 +1,168 @@
+package dhttp
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/streamingfast/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/semconv/v1.17.0/httpconv"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const tracerName = "github.com/streamingfast/dhttp"
+
+type TracingOption func(t *TracingRoundTripper)
+
+// TracingPropagator sets the propagator used to inject the trace context in outgoing
+// requests, defaults to the globally registered one (`otel.GetTextMapPropagator()`)
+// resolved on each request.
+//
+// The global propagator registered by the `middleware` package only injects `traceparent`,
+// use `gcppropagator.CloudTraceFormatPropagator{}` to also inject `X-Cloud-Trace-Context`.
+func TracingPropagator(propagator propagation.TextMapPropagator) TracingOption {
+	return func(t *TracingRoundTripper) {
+		t.propagator = propagator
+	}
+}
+
+// TracingTracerProvider sets the provider of the tracer used to start client spans,
+// defaults to the globally registered one (`otel.GetTracerProvider()`).
+func TracingTracerProvider(provider trace.TracerProvider) TracingOption {
+	return func(t *TracingRoundTripper) {
+		t.tracerProvider = provider
+	}
+}
+
+// TracingLogger sets the logger used to log client spans, the request specific logger
+// is used if one exists in the request's context.
+func TracingLogger(logger *zap.Logger) TracingOption {
+	return func(t *TracingRoundTripper) {
+		t.logger = logger
+	}
+}
+
+// NewTracingRoundTripper creates a wrapping `http.RoundTripper` that starts a client span
+// for each outgoing request, injects the span context in the request's headers so that the
+// trace continues in the upstream service and records the response status (or the transport
+// error) on the span. The span ends once the response body is fully read or closed.
+//
+// If the received `next` argument is set as `nil`, the `http.DefaultTransport` value
+// will be used as the actual transport handler. Wrap it around a `LoggingRoundTripper`
+// so that the logged request contains the injected headers:
+//
+//	NewTracingRoundTripper(NewLoggingRoundTripper(zlog, tracer, nil))
+func NewTracingRoundTripper(next http.RoundTripper, opts ...TracingOption) *TracingRoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	t := &TracingRoundTripper{
+		transport: next,
+		logger:    zlog,
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	return t
+}
+
+type TracingRoundTripper struct {
+	transport      http.RoundTripper
+	logger         *zap.Logger
+	propagator     propagation.TextMapPropagator
+	tracerProvider trace.TracerProvider
+}
+
+func (t *TracingRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	tracerProvider := t.tracerProvider
+	if tracerProvider == nil {
+		tracerProvider = otel.GetTracerProvider()
+	}
+
+	propagator := t.propagator
+	if propagator == nil {
+		propagator = otel.GetTextMapPropagator()
+	}
+
+	ctx, span := tracerProvider.Tracer(tracerName).Start(request.Context(), fmt.Sprintf("HTTP %s", request.Method),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(httpconv.ClientRequest(request)...),
+	)
+
+	spanContext := span.SpanContext()
+	logger := logging.Logger(ctx, t.logger).With(
+		zap.Stringer("trace_id", spanContext.TraceID()),
+		zap.Stringer("span_id", spanContext.SpanID()),
+	)
+
+	// A RoundTripper must not modify the request, we inject headers in a copy
+	request = request.Clone(ctx)
+	propagator.Inject(ctx, propagation.HeaderCarrier(request.Header))
+
+	response, err := t.transport.RoundTrip(request)
+	if err != nil {
+		errorClass := classifyTransportError(err)
+
+		span.RecordError(err)
+		span.SetAttributes(attribute.String("error.class", errorClass))
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+
+		logger.Debug(fmt.Sprintf("HTTP client span %s %s failed", request.Method, request.URL.String()), zap.String("error_class", errorClass), zap.Error(err))
+		return nil, err
+	}
+
+	span.SetAttributes(httpconv.ClientResponse(response)...)
+	span.SetStatus(httpconv.ClientStatus(response.StatusCode))
+
+	logger.Debug(fmt.Sprintf("HTTP client span %s %s completed", request.Method, request.URL.String()), zap.Int("status", response.StatusCode))
+
+	if response.StatusCode == http.StatusSwitchingProtocols {
+		// The body is the upgraded connection (an `io.ReadWriteCloser`), it must be handed
+		// over as is and its lifetime is not part of the request anymore
+		span.End()
+		return response, nil
+	}
+
+	response.Body = &spanEndingBody{ReadCloser: response.Body, span: span}
+	return response, nil
+}
+
+// spanEndingBody ends the span once the body has been fully read or closed.
+type spanEndingBody struct {
+	io.ReadCloser
+	span trace.Span
+	once sync.Once
+}
+
+func (b *spanEndingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.span.RecordError(err)
+	}
+
+	if err != nil {
+		b.end()
+	}
+
+	return n, err
+}
+
+func (b *spanEndingBody) Close() error {
+	defer b.end()
+
+	return b.ReadCloser.Close()
+}
+
+func (b *spanEndingBody) end() {
+	b.once.Do(func() { b.span.End() })
+}
@@ -0,0 +1,47 @@
+package dhttp
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	sftracing "github.com/streamingfast/sf-tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+func TestTracingRoundTripper_InjectsTraceContext(t *testing.T) {
+	var received http.Header
+	transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		received = r.Header
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	})
+
+	traceID := sftracing.NewFixedTraceID("0123456789abcdef0123456789abcdef")
+	ctx := sftracing.WithTraceID(context.Background(), traceID)
+
+	request, _ := http.NewRequestWithContext(ctx, "GET", "http://upstream/", nil)
+	response, err := NewTracingRoundTripper(transport, TracingPropagator(propagation.TraceContext{})).RoundTrip(request)
+	require.NoError(t, err)
+	response.Body.Close()
+
+	traceparent := received.Get("traceparent")
+	require.NotEmpty(t, traceparent)
+	assert.True(t, strings.HasPrefix(traceparent, "00-0123456789abcdef0123456789abcdef-"), traceparent)
+	assert.Empty(t, request.Header.Get("traceparent"), "original request must not be modified")
+}
+
+func TestTracingRoundTripper_SwitchingProtocols(t *testing.T) {
+	upgraded := &readWriteCloser{}
+	transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusSwitchingProtocols, Body: upgraded}, nil
+	})
+
+	request, _ := http.NewRequest("GET", "http://upstream/", nil)
+	response, err := NewTracingRoundTripper(transport).RoundTrip(request)
+	require.NoError(t, err)
+
+	assert.Same(t, upgraded, response.Body)
+}
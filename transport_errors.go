@@ -0,0 +1,63 @@
+package dhttp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"syscall"
+)
+
+const (
+	transportErrorCancelled         = "cancelled"
+	transportErrorTimeout           = "timeout"
+	transportErrorDNS               = "dns"
+	transportErrorConnectionRefused = "connection_refused"
+	transportErrorTLS               = "tls"
+	transportErrorUnknown           = "unknown"
+)
+
+// classifyTransportError maps an error returned by an `http.RoundTripper` to a
+// short class name suitable for logging.
+func classifyTransportError(err error) string {
+	if errors.Is(err, context.Canceled) {
+		return transportErrorCancelled
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return transportErrorDNS
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return transportErrorConnectionRefused
+	}
+
+	if isTLSError(err) {
+		return transportErrorTLS
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return transportErrorTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return transportErrorTimeout
+	}
+
+	return transportErrorUnknown
+}
+
+func isTLSError(err error) bool {
+	var recordHeaderErr tls.RecordHeaderError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateInvalidErr x509.CertificateInvalidError
+
+	return errors.As(err, &recordHeaderErr) ||
+		errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &certificateInvalidErr)
+}
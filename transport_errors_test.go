@@ -0,0 +1,42 @@
+package dhttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_classifyTransportError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{"cancelled", &url.Error{Op: "Get", URL: "http://a", Err: context.Canceled}, transportErrorCancelled},
+		{"deadline", &url.Error{Op: "Get", URL: "http://a", Err: context.DeadlineExceeded}, transportErrorTimeout},
+		{"dns", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "a"}}, transportErrorDNS},
+		{"connection refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, transportErrorConnectionRefused},
+		{"net timeout", &net.OpError{Op: "read", Err: timeoutError{}}, transportErrorTimeout},
+		{"unknown", errors.New("boom"), transportErrorUnknown},
+		{"wrapped unknown", fmt.Errorf("wrapped: %w", errors.New("boom")), transportErrorUnknown},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, classifyTransportError(test.err))
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -1,20 +1,14 @@
 package dhttp
 
 import (
-	"context"
-	"io/ioutil"
 	"net/http"
-	"regexp"
-	"strings"
-
-	"github.com/streamingfast/derr"
+	"net/netip"
 )
 
-var portSuffixRegex = regexp.MustCompile(`:[0-9]{2,5}$`)
-
-// RealIP tries to determine the actual client remote IP that initiated the connection.
-// This method is aware of Google Cloud Load Balancer and if the `X-Forwarded-For` exists
-// and has 2 or more addresses, it will assume it's coming from Google Cloud Load Balancer.
+// RealIP tries to determine the actual client remote IP that initiated the connection using
+// the `DefaultIPExtractor`, which is aware of Google Cloud Load Balancer: if the
+// `X-Forwarded-For` exists and has 2 or more addresses, it will assume it's coming from
+// Google Cloud Load Balancer.
 //
 // When behind a Google Load Balancer, the only two values that we can
 // be sure about are the `n - 2` and `n - 1` (so the last two values
@@ -27,36 +21,20 @@ var portSuffixRegex = regexp.MustCompile(`:[0-9]{2,5}$`)
 // they are coming from an HTTP header and not from Google directly, they
 // can be forged and cannot be trusted.
 //
+// Services deployed behind another kind of proxy, or without any, must replace the
+// `DefaultIPExtractor` or use their own `IPExtractor`.
+//
+// Header entries that are not valid addresses are ignored in favor of the connection's
+// remote address, the returned address is invalid only if the remote address is itself
+// invalid. Use `RealIPString` to get the address as a string.
+//
 // @see https://cloud.google.com/load-balancing/docs/https#x-forwarded-for_header
-func RealIP(r *http.Request) string {
-	xForwardedFor := strings.TrimSpace(r.Header.Get("X-Forwarded-For"))
-	if xForwardedFor != "" {
-		addresses := strings.Split(xForwardedFor, ",")
-		if len(addresses) >= 2 {
-			return addresses[len(addresses)-2]
-		}
-	}
-
-	if r.RemoteAddr != "" {
-		// The RemoteAddr actually has a format of the form `<ip>:<port>`, we remove the port suffix part
-		return portSuffixRegex.ReplaceAllString(r.RemoteAddr, "")
-	}
-
-	return ""
+func RealIP(r *http.Request) netip.Addr {
+	return DefaultIPExtractor.ExtractIP(r)
 }
 
-func FowardResponse(ctx context.Context, w http.ResponseWriter, response *http.Response) {
-	// FIXME: Implement using a Pipe stream insteading of reading the full content in memory
-	content, err := ioutil.ReadAll(response.Body)
-	defer response.Body.Close()
-
-	if err != nil {
-		WriteError(ctx, w, derr.Wrap(err, "unable to read response body while forwarding response"))
-	}
-
-	w.WriteHeader(response.StatusCode)
-	_, err = w.Write(content)
-	if err != nil {
-		logWriteResponseError(ctx, "failed forwarding response", err)
-	}
+// RealIPString is `RealIP` returning the address as a string, empty if it could not be
+// determined.
+func RealIPString(r *http.Request) string {
+	return DefaultIPExtractor.ExtractIPString(r)
 }
@@ -74,7 +74,7 @@ func TestRealIP(t *testing.T) {
 				test.modifier(request)
 			}
 
-			assert.Equal(t, test.expected, RealIP(request))
+			assert.Equal(t, test.expected, RealIPString(request))
 		})
 	}
 }